@@ -0,0 +1,236 @@
+// API key authentication and scope checks
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Scopes which may be granted to an API key
+const (
+	ScopeSend          = "send"
+	ScopeContactsRead  = "contacts:read"
+	ScopeContactsWrite = "contacts:write"
+	ScopeAdmin         = "admin"
+
+	// Any authenticated caller
+	ScopeAny = ""
+)
+
+var validScopes = []string{ScopeSend, ScopeContactsRead, ScopeContactsWrite, ScopeAdmin}
+
+const apiKeyPrefix = "mk_"
+
+// Generate a new key for the given name and scopes. The returned string is
+// the only copy of the plaintext key, only its hash is stored
+func newAPIKey(name string, scopes []string) (APIKey, string) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	check(err)
+
+	key := APIKey{
+		Id:      bson.NewObjectId(),
+		Name:    name,
+		Scopes:  scopes,
+		Created: time.Now().UTC(),
+	}
+	plaintext := apiKeyPrefix + key.Id.Hex() + "_" + hex.EncodeToString(secret)
+	key.Hash = hashAPIKey(plaintext)
+	return key, plaintext
+}
+
+func hashAPIKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+// Check all requested scopes are known
+func validateScopes(scopes []string) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, scope := range scopes {
+		known := false
+		for _, valid := range validScopes {
+			if scope == valid {
+				known = true
+			}
+		}
+		if !known {
+			return false
+		}
+	}
+	return true
+}
+
+// Authenticated caller, either an API key or a logged in user
+type Identity struct {
+	Name     string
+	ClientId string
+	UserId   bson.ObjectId
+	Scopes   []string
+
+	// Addresses ("me@example.com") or domains ("example.com") the caller
+	// may send from. Empty means unrestricted
+	AllowedFrom []string
+
+	// Set for session (cookie) authentication only
+	csrfToken string
+}
+
+type identityKey struct{}
+
+// Resolve the caller from an "Authorization: Bearer <key>" header, the
+// session cookie of a logged in user or a TLS client certificate
+func authenticate(req *http.Request) (Identity, bool) {
+	if len(req.Header.Get("Authorization")) == 0 {
+		identity, ok := authenticateSession(req)
+		if !ok {
+			return authenticateClientCert(req)
+		}
+		return identity, true
+	}
+	key, ok := authenticateAPIKey(req)
+	if !ok {
+		return Identity{}, false
+	}
+	clientId := "key:" + key.Id.Hex()
+	if len(key.Id) == 0 {
+		clientId = "key:" + key.Name
+	}
+	return Identity{Name: key.Name, ClientId: clientId, Scopes: key.Scopes, AllowedFrom: key.AllowedFrom}, true
+}
+
+// Resolve the API key sent as "Authorization: Bearer <key>". The legacy
+// Password is still accepted as a bootstrap key with the admin scope
+func authenticateAPIKey(req *http.Request) (APIKey, bool) {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return APIKey{}, false
+	}
+	plaintext := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	if len(plaintext) == 0 {
+		return APIKey{}, false
+	}
+
+	if len(Password) > 0 && subtle.ConstantTimeCompare([]byte(plaintext), []byte(Password)) == 1 {
+		return APIKey{Name: "bootstrap", Scopes: []string{ScopeAdmin}}, true
+	}
+
+	// Keys are of the form mk_<id>_<secret>
+	pieces := strings.Split(strings.TrimPrefix(plaintext, apiKeyPrefix), "_")
+	if !strings.HasPrefix(plaintext, apiKeyPrefix) || len(pieces) != 2 || !bson.IsObjectIdHex(pieces[0]) {
+		return APIKey{}, false
+	}
+	key, err := requestStore(req).RetrieveAPIKey(pieces[0])
+	if err != nil || key.Revoked {
+		return APIKey{}, false
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(plaintext)), []byte(key.Hash)) != 1 {
+		return APIKey{}, false
+	}
+	return key, true
+}
+
+// Whether the caller is granted the scope. Admin implies every scope
+func (identity Identity) HasScope(scope string) bool {
+	return scopesGrant(identity.Scopes, scope)
+}
+
+func scopesGrant(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the caller may send with the given From address. Admins may
+// always send, otherwise From must match an allowed address or domain
+func (identity Identity) CanSendFrom(from string) bool {
+	if len(identity.AllowedFrom) == 0 || identity.HasScope(ScopeAdmin) {
+		return true
+	}
+	from = strings.ToLower(strings.TrimSpace(from))
+	domain := from[strings.LastIndex(from, "@")+1:]
+	for _, allowed := range identity.AllowedFrom {
+		allowed = strings.ToLower(allowed)
+		if strings.Contains(strings.TrimPrefix(allowed, "@"), "@") {
+			if allowed == from {
+				return true
+			}
+		} else if strings.TrimPrefix(allowed, "@") == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// Check every role grants only known scopes
+func validateRoles(roles map[string]RolePolicy) error {
+	for name, policy := range roles {
+		if !validateScopes(policy.Scopes) {
+			return fmt.Errorf("role %s has invalid scopes %v", name, policy.Scopes)
+		}
+	}
+	return nil
+}
+
+// The Identity stored on the request by authHandler
+func requestIdentity(req *http.Request) Identity {
+	identity, _ := req.Context().Value(identityKey{}).(Identity)
+	return identity
+}
+
+// Copy of the request carrying the Identity
+func withIdentity(req *http.Request, identity Identity) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), identityKey{}, identity))
+}
+
+// Authenticate the request and check the scope, writing 401 or 403 and
+// returning false if the caller is not allowed. ScopeAny only requires
+// a valid key or session. Session callers must send the CSRF token with
+// anything but safe methods
+func requireScope(w http.ResponseWriter, req *http.Request, scope string) (Identity, bool) {
+	identity, ok := authenticate(req)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="maelstrom"`)
+		writeError(w, req, 401, "Unauthorized.")
+		return Identity{}, false
+	}
+	if len(identity.csrfToken) > 0 && !isSafeMethod(req) && !validCsrfToken(req, identity.csrfToken) {
+		writeError(w, req, 403, "Invalid CSRF token.")
+		return Identity{}, false
+	}
+	if scope != ScopeAny && !identity.HasScope(scope) {
+		writeError(w, req, 403, "Requires the "+scope+" scope.")
+		return Identity{}, false
+	}
+	return identity, true
+}
+
+func isSafeMethod(req *http.Request) bool {
+	return req.Method == "GET" || req.Method == "HEAD"
+}
+
+// Auth Handler Wrapper requiring scope. Routes are registered per method,
+// so reads and writes of a resource are wrapped separately
+func authHandler(scope string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		identity, ok := requireScope(w, req, scope)
+		if !ok {
+			return
+		}
+		fn(w, withIdentity(req, identity))
+	}
+}
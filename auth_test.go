@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	fmt.Println("Running Test: TestAPIKeyAuthentication")
+
+	// Setup
+	datastore = NewMockDatastore()
+	Password = "bootstrap"
+	handler := buildTestHandler()
+	body := `{"to":["a@example.com"],"from":"me@example.com","subject":"Hi","text":"Hi"}`
+
+	res := doRequest(handler, "POST", "/messages/?password=bootstrap", body)
+	if res.Code != 401 {
+		t.Errorf("Query string password returned %d should be 401.", res.Code)
+	}
+
+	res = doAuthRequest(handler, "POST", "/messages/", body, buildTestKey(ScopeContactsRead))
+	if res.Code != 403 {
+		t.Errorf("Key without send scope returned %d should be 403.", res.Code)
+	}
+
+	// Create and revoke a key through the API
+	res = doAuthRequest(handler, "POST", "/apikeys/", `{"name":"client","scopes":["send"]}`, "bootstrap")
+	if res.Code != 201 {
+		t.Fatalf("Create API key returned %d should be 201.", res.Code)
+	}
+	var created struct {
+		Id  string `json:"id"`
+		Key string `json:"key"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &created)
+	if _, ok := authenticate(authRequest(created.Key)); !ok {
+		t.Errorf("Created key should authenticate.")
+	}
+	if _, ok := authenticate(authRequest(created.Key + "0")); ok {
+		t.Errorf("Modified key should not authenticate.")
+	}
+
+	res = doAuthRequest(handler, "DELETE", "/apikeys/"+created.Id, "", "bootstrap")
+	if res.Code != 200 {
+		t.Errorf("Revoke API key returned %d should be 200.", res.Code)
+	}
+	if _, ok := authenticate(authRequest(created.Key)); ok {
+		t.Errorf("Revoked key should not authenticate.")
+	}
+
+	res = doAuthRequest(handler, "POST", "/apikeys/", `{"name":"client","scopes":["everything"]}`, "bootstrap")
+	if res.Code != 400 {
+		t.Errorf("Unknown scope returned %d should be 400.", res.Code)
+	}
+
+	Password = ""
+	fmt.Println("Test Complete.")
+}
+
+func TestRoutesRequireAuthentication(t *testing.T) {
+	fmt.Println("Running Test: TestRoutesRequireAuthentication")
+
+	// Setup
+	datastore = NewMockDatastore()
+	handler := buildTestHandler()
+
+	routes := []struct {
+		method string
+		url    string
+	}{
+		{"POST", "/messages/"},
+		{"GET", "/status"},
+		{"GET", "/contacts/"},
+		{"POST", "/contacts/"},
+		{"PUT", "/contacts/" + bson.NewObjectId().Hex()},
+		{"DELETE", "/contacts/" + bson.NewObjectId().Hex()},
+		{"GET", "/suppressions/"},
+		{"POST", "/suppressions/"},
+		{"GET", "/apikeys/"},
+	}
+	for _, route := range routes {
+		res := doRequest(handler, route.method, route.url, "{}")
+		if res.Code != 401 {
+			t.Errorf("Unauthenticated %s %s returned %d should be 401.", route.method, route.url, res.Code)
+		}
+		res = doAuthRequest(handler, route.method, route.url, "{}", "mk_invalid")
+		if res.Code != 401 {
+			t.Errorf("Invalid key %s %s returned %d should be 401.", route.method, route.url, res.Code)
+		}
+	}
+
+	// Read only keys cannot modify contacts
+	readKey := buildTestKey(ScopeContactsRead)
+	res := doAuthRequest(handler, "GET", "/contacts/", "", readKey)
+	if res.Code != 200 {
+		t.Errorf("Read key GET /contacts/ returned %d should be 200.", res.Code)
+	}
+	res = doAuthRequest(handler, "DELETE", "/contacts/"+bson.NewObjectId().Hex(), "", readKey)
+	if res.Code != 403 {
+		t.Errorf("Read key DELETE /contacts/ returned %d should be 403.", res.Code)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestRolePolicy(t *testing.T) {
+	fmt.Println("Running Test: TestRolePolicy")
+
+	// Setup
+	datastore = NewMockDatastore()
+	config = Config{Roles: map[string]RolePolicy{
+		"marketing": {Scopes: []string{ScopeSend}, AllowedFrom: []string{"news@example.com", "@promo.example.com"}},
+		"editor":    {Scopes: []string{ScopeContactsRead, ScopeContactsWrite}},
+		"admin":     {Scopes: []string{ScopeAdmin}, AllowedFrom: []string{"nobody@example.com"}},
+	}}
+	handler := buildTestHandler()
+
+	marketing := userIdentity(User{Username: "m", Roles: []string{"marketing"}})
+	if !marketing.CanSendFrom("News@Example.com") || !marketing.CanSendFrom("sale@promo.example.com") {
+		t.Errorf("Marketing should send from allowed addresses and domains.")
+	}
+	if marketing.CanSendFrom("ceo@example.com") {
+		t.Errorf("Marketing should not send from ceo@example.com.")
+	}
+	if !userIdentity(User{Roles: []string{"admin"}}).CanSendFrom("ceo@example.com") {
+		t.Errorf("Admins should send from any address.")
+	}
+	if userIdentity(User{Roles: []string{"editor"}}).HasScope(ScopeSend) {
+		t.Errorf("Editors should not be granted send.")
+	}
+
+	req := httptest.NewRequest("POST", "/messages/", strings.NewReader(`{"to":["a@example.com"],"from":"ceo@example.com","subject":"Hi","text":"Hi"}`))
+	res := httptest.NewRecorder()
+	messageHandler(res, withIdentity(req, marketing))
+	if res.Code != 403 {
+		t.Errorf("Send from disallowed address returned %d should be 403.", res.Code)
+	}
+
+	res = doAuthRequest(handler, "GET", "/providers/", "", buildTestKey(ScopeSend, ScopeContactsWrite))
+	if res.Code != 403 {
+		t.Errorf("Non admin GET /providers/ returned %d should be 403.", res.Code)
+	}
+
+	config = Config{}
+	fmt.Println("Test Complete.")
+}
@@ -0,0 +1,481 @@
+// Loading, validating and hot reloading the configuration
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var configFile = "conf.json"
+
+// How often the config file is checked for changes
+var configPollPeriod = 5 * time.Second
+
+// Guards config, which a reload replaces while requests read it
+var configLock sync.RWMutex
+
+// Serializes reloads from the watcher and SIGHUP
+var reloadLock sync.Mutex
+
+func currentConfig() Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return config
+}
+
+func setConfig(conf Config) {
+	configLock.Lock()
+	config = conf
+	configLock.Unlock()
+}
+
+// A single setting from an environment variable or command line flag,
+// e.g. MAELSTROM_MAILSERVERS_0_APIKEY or -set mailServers.0.apiKey=...
+type configSetting struct {
+	Source string
+	Path   []string
+	Value  string
+}
+
+// Settings layered over the config file each time it is loaded,
+// environment variables first and then command line flags
+var configOverrides []configSetting
+
+// Errors found in a config, all reported together
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+func defaultConfig() Config {
+	return Config{Port: "8123", PingPeriod: 60, ShutdownTimeout: 30, ShutdownDrainSeconds: 5, EmailThrottle: 5}
+}
+
+// Settings from PORT and MAELSTROM_* environment variables. Path elements
+// are separated by underscores and matched case insensitively
+func envSettings(environ []string) []configSetting {
+	settings := []configSetting{}
+	for _, entry := range environ {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name, value := parts[0], parts[1]
+		if name == "PORT" {
+			settings = append(settings, configSetting{name, []string{"port"}, value})
+		} else if strings.HasPrefix(name, "MAELSTROM_") && name != "MAELSTROM_CONFIG" {
+			path := strings.Split(strings.ToLower(strings.TrimPrefix(name, "MAELSTROM_")), "_")
+			settings = append(settings, configSetting{name, path, value})
+		}
+	}
+	sort.SliceStable(settings, func(i, j int) bool {
+		return settings[i].Source == "PORT" && settings[j].Source != "PORT"
+	})
+	return settings
+}
+
+// Setting from a -set flag, a dotted path and value such as
+// mailServers.0.apiKey=key
+func parseSetting(setting string) (configSetting, error) {
+	parts := strings.SplitN(setting, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return configSetting{}, fmt.Errorf("%s should be path=value", setting)
+	}
+	return configSetting{"-set " + parts[0], strings.Split(parts[0], "."), parts[1]}, nil
+}
+
+// Build the config from the defaults, the file at path, if any, and the
+// overrides, then validate it
+func loadConfig(path string) (Config, error) {
+	conf := defaultConfig()
+	errs := configErrors{}
+	if len(path) > 0 {
+		err := readConfigFile(path, &conf)
+		if os.IsNotExist(err) {
+			return conf, err
+		}
+		if fileErrs, ok := err.(configErrors); ok {
+			errs = append(errs, fileErrs...)
+		} else if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, setting := range configOverrides {
+		err := setConfigValue(reflect.ValueOf(&conf).Elem(), setting.Path, setting.Value)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", setting.Source, err))
+		}
+	}
+	errs = append(errs, resolveSecrets(&conf)...)
+	if err := validateConfig(conf); err != nil {
+		errs = append(errs, err.(configErrors)...)
+	}
+	if len(errs) > 0 {
+		return conf, errs
+	}
+	return conf, nil
+}
+
+// Decode a JSON, YAML or TOML config file, chosen by its extension, over
+// conf. Keys are matched case insensitively and unknown keys are errors
+func readConfigFile(path string, conf *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var tree interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+		tree = stringKeys(tree)
+	case ".toml":
+		table := map[string]interface{}{}
+		err = toml.Unmarshal(data, &table)
+		tree = table
+	default:
+		err = json.Unmarshal(data, &tree)
+	}
+	if err != nil {
+		return fmt.Errorf("%s could not be parsed: %v", path, err)
+	}
+
+	errs := configErrors{}
+	for _, key := range unknownKeys(tree, reflect.TypeOf(*conf), "") {
+		errs = append(errs, fmt.Sprintf("%s: unknown setting %s", path, key))
+	}
+	data, _ = json.Marshal(tree)
+	err = json.Unmarshal(data, conf)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("%s: %v", path, err))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// YAML maps have interface{} keys, which JSON can't encode
+func stringKeys(tree interface{}) interface{} {
+	switch value := tree.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			result[fmt.Sprint(k)] = stringKeys(v)
+		}
+		return result
+	case []interface{}:
+		for i, v := range value {
+			value[i] = stringKeys(v)
+		}
+	}
+	return tree
+}
+
+// Dotted paths of keys in a decoded config file that match no field
+func unknownKeys(tree interface{}, t reflect.Type, prefix string) []string {
+	unknown := []string{}
+	switch t.Kind() {
+	case reflect.Struct:
+		values, _ := tree.(map[string]interface{})
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field, ok := fieldNamed(t, key)
+			if !ok {
+				unknown = append(unknown, prefix+key)
+				continue
+			}
+			unknown = append(unknown, unknownKeys(values[key], field.Type, prefix+key+".")...)
+		}
+	case reflect.Slice:
+		values, _ := tree.([]interface{})
+		for i, value := range values {
+			unknown = append(unknown, unknownKeys(value, t.Elem(), prefix+strconv.Itoa(i)+".")...)
+		}
+	case reflect.Map:
+		values, _ := tree.(map[string]interface{})
+		for key, value := range values {
+			unknown = append(unknown, unknownKeys(value, t.Elem(), prefix+key+".")...)
+		}
+	}
+	return unknown
+}
+
+func fieldNamed(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(t.Field(i).Name, name) {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// Set the config value at path, e.g. mailServers 0 apiKey. Slices grow by
+// one when path names the index just past their end
+func setConfigValue(v reflect.Value, path []string, value string) error {
+	if len(path) == 0 {
+		return setScalar(v, value)
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		field, ok := fieldNamed(v.Type(), path[0])
+		if ok {
+			return setConfigValue(v.FieldByIndex(field.Index), path[1:], value)
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			break
+		}
+		index, err := strconv.Atoi(path[0])
+		if err != nil || index < 0 || index > v.Len() {
+			return fmt.Errorf("no entry %s, there are %d", path[0], v.Len())
+		}
+		if index == v.Len() {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		}
+		return setConfigValue(v.Index(index), path[1:], value)
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		key := reflect.ValueOf(path[0])
+		for _, existing := range v.MapKeys() {
+			if strings.EqualFold(existing.String(), path[0]) {
+				key = existing
+			}
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if current := v.MapIndex(key); current.IsValid() {
+			elem.Set(current)
+		}
+		err := setConfigValue(elem, path[1:], value)
+		if err == nil {
+			v.SetMapIndex(key, elem)
+		}
+		return err
+	}
+	return fmt.Errorf("unknown setting %s", strings.Join(path, "."))
+}
+
+// Parse value into a string, number, bool or comma separated list
+func setScalar(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("a list of settings needs an index")
+		}
+		items := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("a group of settings can't be set to a single value")
+	}
+	return nil
+}
+
+// Check a config for mistakes that would otherwise only show up at
+// runtime, returning all of them
+func validateConfig(conf Config) error {
+	errs := configErrors{}
+	if len(conf.Port) > 0 {
+		port, err := strconv.Atoi(conf.Port)
+		if err != nil || port < 1 || port > 65535 {
+			errs = append(errs, fmt.Sprintf("Port %q is not a valid port", conf.Port))
+		}
+	}
+	names := make(map[string]bool)
+	for i, server := range conf.MailServers {
+		if newMailSender(server) == nil {
+			errs = append(errs, fmt.Sprintf("mailServers.%d: unknown Mail Server %q, should be one of MailGun, SendGrid, Mandrill or AWS", i, server.Name))
+		} else if names[server.Name] {
+			errs = append(errs, fmt.Sprintf("mailServers.%d: Mail Server %s configured twice", i, server.Name))
+		}
+		names[server.Name] = true
+		if !validRateLimit(server.Limits) {
+			errs = append(errs, fmt.Sprintf("mailServers.%d: Mail Server %s has negative limits", i, server.Name))
+		}
+	}
+	if conf.PingPeriod <= 0 {
+		errs = append(errs, fmt.Sprintf("PingPeriod must be positive, got %d", conf.PingPeriod))
+	}
+	if conf.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Sprintf("ShutdownTimeout must not be negative, got %d", conf.ShutdownTimeout))
+	}
+	if conf.ShutdownDrainSeconds < 0 {
+		errs = append(errs, fmt.Sprintf("ShutdownDrainSeconds must not be negative, got %d", conf.ShutdownDrainSeconds))
+	}
+	if conf.EmailThrottle < 0 {
+		errs = append(errs, fmt.Sprintf("EmailThrottle must not be negative, got %d", conf.EmailThrottle))
+	}
+	if !validRateLimit(conf.RateLimits.PerClient) || !validRateLimit(conf.RateLimits.PerIP) || !validRateLimit(conf.RateLimits.PerDomain) {
+		errs = append(errs, "RateLimits must not be negative")
+	}
+	if _, err := parseNetworks(conf.RateLimits.TrustedProxies); err != nil {
+		errs = append(errs, "RateLimits.TrustedProxies: "+err.Error())
+	}
+	if len(conf.LogLevel) > 0 {
+		_, err := parseLogLevel(conf.LogLevel)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(conf.LogFormat) > 0 && conf.LogFormat != "json" && conf.LogFormat != "logfmt" {
+		errs = append(errs, fmt.Sprintf("LogFormat must be json or logfmt, got %q", conf.LogFormat))
+	}
+	if conf.Tracing.SampleRatio < 0 || conf.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Sprintf("Tracing.SampleRatio must be between 0 and 1, got %v", conf.Tracing.SampleRatio))
+	}
+	errs = append(errs, validateTLS(conf.TLS, effectiveRoles(conf.Roles))...)
+	roles := make([]string, 0, len(conf.Roles))
+	for name := range conf.Roles {
+		roles = append(roles, name)
+	}
+	sort.Strings(roles)
+	for _, name := range roles {
+		err := validateRoles(map[string]RolePolicy{name: conf.Roles[name]})
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validRateLimit(limit RateLimit) bool {
+	return limit.Rate >= 0 && limit.Burst >= 0 && limit.Daily >= 0
+}
+
+// Load the config file again and apply it. An invalid file is rejected
+// and the current config stays active
+func reloadConfig(path string) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	conf, err := loadConfig(path)
+	if err != nil {
+		Log.Error("Config reload rejected, keeping the current config", "file", path, "error", err)
+		configReloads.Inc("rejected")
+		return err
+	}
+	applyConfig(currentConfig(), conf)
+	configReloads.Inc("applied")
+	Log.Info("Config reloaded", "file", path)
+	return nil
+}
+
+// Make conf the active config, rebuilding only what changed. Sends in
+// flight keep the Mail Servers they were given
+func applyConfig(previous Config, conf Config) {
+	setConfig(conf)
+
+	if conf.LogLevel != previous.LogLevel {
+		level, _ := parseLogLevel(conf.LogLevel)
+		setLogLevel(level)
+	}
+	if !reflect.DeepEqual(conf.OIDC, previous.OIDC) {
+		resetOIDC()
+	}
+	if conf.EmailThrottle != previous.EmailThrottle || !reflect.DeepEqual(conf.RateLimits, previous.RateLimits) {
+		initRateLimits()
+	}
+	if !reflect.DeepEqual(conf.MailServers, previous.MailServers) {
+		buildServersMap()
+	}
+	if conf.PingPeriod != previous.PingPeriod {
+		resizePingHistories()
+		if pinging() {
+			stopPing()
+			initiatePing()
+		}
+	}
+	if conf.LogFileName != previous.LogFileName || conf.LogRotation != previous.LogRotation ||
+		conf.LogFormat != previous.LogFormat || conf.LogMessageBodies != previous.LogMessageBodies ||
+		!reflect.DeepEqual(conf.Tracing, previous.Tracing) || conf.UnsubscribeSecret != previous.UnsubscribeSecret ||
+		conf.MongoUrl != previous.MongoUrl || listenerChanged(conf.TLS, previous.TLS) {
+		Log.Warn("Logging, tracing, unsubscribe secret, MongoDB and TLS listener changes take effect on restart")
+	}
+}
+
+// Whether TLS settings read only when serving starts changed. HSTS and
+// client certificate roles apply immediately
+func listenerChanged(conf TLSConfig, previous TLSConfig) bool {
+	conf.ClientCerts, previous.ClientCerts = nil, nil
+	conf.HSTSMaxAge, previous.HSTSMaxAge = 0, 0
+	conf.HSTSIncludeSubdomains, previous.HSTSIncludeSubdomains = false, false
+	return !reflect.DeepEqual(conf, previous)
+}
+
+// Reload the config whenever the file's size or modification time changes
+func watchConfig(path string) {
+	last, _ := os.Stat(path)
+	ticker := time.Tick(configPollPeriod)
+	go func() {
+		for range ticker {
+			info, err := os.Stat(path)
+			if err != nil || (last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size()) {
+				continue
+			}
+			last = info
+			reloadConfig(path)
+		}
+	}()
+}
+
+// On SIGHUP reopen the log file, so logrotate can move it, and reload
+// the config if it was read from a file
+func handleHangup(path string) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			reopenLogFile()
+			if len(path) > 0 {
+				reloadConfig(path)
+			}
+		}
+	}()
+}
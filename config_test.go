@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, path string, content string) {
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	fmt.Println("Running Test: TestValidateConfig")
+
+	valid := Config{PingPeriod: 60, EmailThrottle: 5, MailServers: []MailServer{{Name: "MailGun"}, {Name: "AWS"}}}
+	if err := validateConfig(valid); err != nil {
+		t.Errorf("Valid config rejected: %v", err)
+	}
+	for name, conf := range map[string]Config{
+		"unknown Mail Server": {PingPeriod: 60, MailServers: []MailServer{{Name: "Postmark"}}},
+		"configured twice":    {PingPeriod: 60, MailServers: []MailServer{{Name: "MailGun"}, {Name: "MailGun"}}},
+		"negative limits":     {PingPeriod: 60, MailServers: []MailServer{{Name: "MailGun", Limits: RateLimit{Daily: -1}}}},
+		"PingPeriod":          {},
+		"EmailThrottle":       {PingPeriod: 60, EmailThrottle: -1},
+		"RateLimits":          {PingPeriod: 60, RateLimits: RateLimitConfig{PerIP: RateLimit{Rate: -1}}},
+		"log level":           {PingPeriod: 60, LogLevel: "loud"},
+		"SampleRatio":         {PingPeriod: 60, Tracing: TracingConfig{SampleRatio: 2}},
+		"invalid scopes":      {PingPeriod: 60, Roles: map[string]RolePolicy{"sender": {Scopes: []string{"everything"}}}},
+	} {
+		err := validateConfig(conf)
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("Config with %s gave error %v", name, err)
+		}
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestReloadConfig(t *testing.T) {
+	fmt.Println("Running Test: TestReloadConfig")
+
+	// Setup
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer provider.Close()
+	dir, _ := ioutil.TempDir("", "maelstrom")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "conf.json")
+	datastore = NewMockDatastore()
+	config = Config{PingPeriod: 60, EmailThrottle: 5}
+	initiatePing()
+	defer stopPing()
+
+	writeTestConfig(t, path, `{"mailServers":[{"name":"MailGun","url":"`+provider.URL+`/"}],"pingPeriod":60,"emailThrottle":5}`)
+	if err := reloadConfig(path); err != nil {
+		t.Fatalf("Valid config rejected: %v", err)
+	}
+	held := chooseMailSender(context.Background(), 1)
+	if held == nil || held.GetName() != "MailGun" {
+		t.Fatalf("MailGun not selectable after reload, got %v", held)
+	}
+
+	// Changed Mail Servers are rebuilt, earlier instances are left alone
+	writeTestConfig(t, path, `{"mailServers":[{"name":"MailGun","url":"`+provider.URL+`/v2/"}],"pingPeriod":30,"emailThrottle":5}`)
+	if err := reloadConfig(path); err != nil {
+		t.Fatalf("Valid config rejected: %v", err)
+	}
+	current := chooseMailSender(context.Background(), 1)
+	if current == nil || current == held {
+		t.Errorf("Mail Servers not rebuilt on reload")
+	}
+	if held.(*MailGunServer).Server.Url != provider.URL+"/" {
+		t.Errorf("Mail Server held by a send changed to %s", held.(*MailGunServer).Server.Url)
+	}
+	if currentConfig().PingPeriod != 30 {
+		t.Errorf("PingPeriod %d should be 30", currentConfig().PingPeriod)
+	}
+
+	// Invalid configs leave the current one active
+	for _, invalid := range []string{
+		`{"mailServers":[],"pingPeriod":0}`,
+		`{"mailServers":[{"name":"Postmark"}],"pingPeriod":60}`,
+		`{"pingPeriod":`,
+	} {
+		writeTestConfig(t, path, invalid)
+		if err := reloadConfig(path); err == nil {
+			t.Errorf("Invalid config %s accepted", invalid)
+		}
+		if currentConfig().PingPeriod != 30 || len(currentConfig().MailServers) != 1 || chooseMailSender(context.Background(), 1) != current {
+			t.Errorf("Config changed by rejected reload of %s", invalid)
+		}
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestWatchConfig(t *testing.T) {
+	fmt.Println("Running Test: TestWatchConfig")
+
+	// Setup
+	dir, _ := ioutil.TempDir("", "maelstrom")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "conf.json")
+	writeTestConfig(t, path, `{"pingPeriod":60,"emailThrottle":5}`)
+	config = Config{PingPeriod: 60, EmailThrottle: 5}
+	configPollPeriod = 10 * time.Millisecond
+	defer func() { configPollPeriod = 5 * time.Second }()
+	watchConfig(path)
+
+	writeTestConfig(t, path, `{"pingPeriod":60,"emailThrottle":10}`)
+	deadline := time.Now().Add(2 * time.Second)
+	for currentConfig().EmailThrottle != 10 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if currentConfig().EmailThrottle != 10 {
+		t.Errorf("Changed config file not reloaded")
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	fmt.Println("Running Test: TestLoadConfigLayers")
+
+	// Setup
+	dir, _ := ioutil.TempDir("", "maelstrom")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "conf.yaml")
+	writeTestConfig(t, path, "mailServers:\n  - name: MailGun\n    url: https://api.mailgun.net/v3/\npingPeriod: 30\nrateLimits:\n  perClient:\n    rate: 2\n")
+	configOverrides = envSettings([]string{
+		"HOME=/root",
+		"MAELSTROM_PORT=9001",
+		"PORT=9000",
+		"MAELSTROM_MAILSERVERS_0_APIKEY=secret",
+		"MAELSTROM_MAILSERVERS_1_NAME=AWS",
+		"MAELSTROM_PINGPERIOD=45",
+		"MAELSTROM_ROLES_SENDER_SCOPES=" + ScopeSend,
+	})
+	setting, err := parseSetting("pingPeriod=90")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configOverrides = append(configOverrides, setting)
+	defer func() { configOverrides = nil }()
+
+	conf, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Config rejected: %v", err)
+	}
+	if len(conf.MailServers) != 2 || conf.MailServers[0].Url != "https://api.mailgun.net/v3/" || conf.MailServers[0].ApiKey != "secret" || conf.MailServers[1].Name != "AWS" {
+		t.Errorf("Mail Servers not layered: %v", conf.MailServers)
+	}
+	if conf.Port != "9001" {
+		t.Errorf("Port %s should be 9001 from MAELSTROM_PORT over PORT", conf.Port)
+	}
+	if conf.PingPeriod != 90 {
+		t.Errorf("PingPeriod %d should be 90 from the flag", conf.PingPeriod)
+	}
+	if conf.EmailThrottle != 5 || conf.RateLimits.PerClient.Rate != 2 {
+		t.Errorf("Defaults and file values lost: %v %v", conf.EmailThrottle, conf.RateLimits)
+	}
+	if len(conf.Roles["sender"].Scopes) != 1 || conf.Roles["sender"].Scopes[0] != ScopeSend {
+		t.Errorf("Role not set from the environment: %v", conf.Roles)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestLoadConfigReportsAllErrors(t *testing.T) {
+	fmt.Println("Running Test: TestLoadConfigReportsAllErrors")
+
+	// Setup
+	dir, _ := ioutil.TempDir("", "maelstrom")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "conf.json")
+	writeTestConfig(t, path, `{"mailServers":[{"name":"Postmark","apiKeys":""}],"pingPerod":60,"emailThrottle":-1}`)
+	configOverrides = envSettings([]string{"MAELSTROM_NOSUCH=1", "MAELSTROM_PINGPERIOD=often"})
+	defer func() { configOverrides = nil }()
+
+	_, err := loadConfig(path)
+	errs, ok := err.(configErrors)
+	if !ok {
+		t.Fatalf("Expected config errors, got %v", err)
+	}
+	for _, expected := range []string{
+		"unknown setting mailServers.0.apiKeys",
+		"unknown setting pingPerod",
+		"MAELSTROM_NOSUCH: unknown setting nosuch",
+		`MAELSTROM_PINGPERIOD: "often" is not a whole number`,
+		`unknown Mail Server "Postmark"`,
+		"EmailThrottle must not be negative",
+	} {
+		if !strings.Contains(errs.Error(), expected) {
+			t.Errorf("Error %q not reported in %v", expected, errs)
+		}
+	}
+
+	fmt.Println("Test Complete.")
+}
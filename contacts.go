@@ -0,0 +1,140 @@
+// Contact validation and merge helpers shared by Datastore implementations
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var contactEmailRegex = regexp.MustCompile("^" + emailRegex + "$")
+var fieldNameRegex = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9_]*$")
+
+// Trim and lower case the contact's Email, returning ErrInvalidEmail
+// if the result is not a single well formed address. Custom fields are
+// checked and RFC 3339 strings are stored as times
+func normalizeContact(contact *Contact) error {
+	contact.Email = strings.ToLower(strings.TrimSpace(contact.Email))
+	if !contactEmailRegex.MatchString(contact.Email) {
+		return ErrInvalidEmail
+	}
+	for name, value := range contact.Fields {
+		if !fieldNameRegex.MatchString(name) {
+			return ErrInvalidField
+		}
+		switch v := value.(type) {
+		case string:
+			if t, err := time.Parse(time.RFC3339, v); err == nil {
+				contact.Fields[name] = t
+			}
+		case float64, int, int64, bool, time.Time:
+		default:
+			return ErrInvalidField
+		}
+	}
+	return nil
+}
+
+// Values a custom field query parameter may match. Query strings are
+// untyped so numbers, booleans and times are tried along with the string
+func fieldQueryValues(value string) []interface{} {
+	values := []interface{}{value}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		values = append(values, f)
+	}
+	if b, err := strconv.ParseBool(value); err == nil {
+		values = append(values, b)
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		values = append(values, t)
+	}
+	return values
+}
+
+// Combine source into target. Target values win, empty target values and
+// Fields are filled from source and Tags are the union of both
+func mergeContacts(target Contact, source Contact) Contact {
+	if len(target.Name) == 0 {
+		target.Name = source.Name
+	}
+
+	fields := ContactFields{}
+	for name, value := range source.Fields {
+		fields[name] = value
+	}
+	for name, value := range target.Fields {
+		fields[name] = value
+	}
+	if len(fields) > 0 {
+		target.Fields = fields
+	}
+
+	seen := make(map[string]bool)
+	tags := []string{}
+	for _, tag := range append(target.Tags, source.Tags...) {
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	target.Tags = tags
+	return target
+}
+
+// Apply a JSON Merge Patch (RFC 7396) to the contact. The Id and Version
+// are not patchable and are always kept from the original
+func applyContactPatch(contact Contact, patch []byte) (Contact, error) {
+	var patchDoc interface{}
+	if err := json.Unmarshal(patch, &patchDoc); err != nil {
+		return Contact{}, err
+	}
+	patchMap, ok := patchDoc.(map[string]interface{})
+	if !ok {
+		return Contact{}, errors.New("merge patch must be a JSON object")
+	}
+
+	original, err := json.Marshal(contact)
+	if err != nil {
+		return Contact{}, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(original, &doc); err != nil {
+		return Contact{}, err
+	}
+
+	patched, err := json.Marshal(mergePatch(doc, patchMap))
+	if err != nil {
+		return Contact{}, err
+	}
+	var result Contact
+	if err := json.Unmarshal(patched, &result); err != nil {
+		return Contact{}, err
+	}
+	result.Id = contact.Id
+	result.Version = contact.Version
+	return result, nil
+}
+
+// Recursively merge patch into target, null values remove keys
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = make(map[string]interface{})
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(target, key)
+			continue
+		}
+		if patchValue, ok := value.(map[string]interface{}); ok {
+			targetValue, _ := target[key].(map[string]interface{})
+			target[key] = mergePatch(targetValue, patchValue)
+			continue
+		}
+		target[key] = value
+	}
+	return target
+}
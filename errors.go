@@ -0,0 +1,84 @@
+// JSON error responses shared by all handlers
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Body of every error response, e.g.
+// {"code":"bad_request","message":"Invalid 'To' Email Address.","details":[{"field":"to","message":"..."}],"requestId":"..."}
+type APIError struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	Details   []FieldError `json:"details,omitempty"`
+	RequestId string       `json:"requestId,omitempty"`
+}
+
+// A problem with one field of the request body
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Machine readable code for an HTTP status, e.g. not_found for 404
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if len(text) == 0 {
+		return "error"
+	}
+	return strings.ToLower(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+}
+
+// Write status with an APIError body carrying the request's ID
+func writeError(w http.ResponseWriter, req *http.Request, status int, message string, details ...FieldError) {
+	body, _ := json.Marshal(APIError{Code: errorCode(status), Message: message, Details: details, RequestId: requestId(req)})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s\n", body)
+}
+
+// Serve the files under dir, answering misses with an error response
+func fileHandler(dir string) http.HandlerFunc {
+	files := http.FileServer(http.Dir(dir))
+	return func(w http.ResponseWriter, req *http.Request) {
+		recorder := &notFoundRecorder{ResponseWriter: w}
+		files.ServeHTTP(recorder, req)
+		if recorder.notFound {
+			writeError(w, req, 404, "No such file "+req.URL.Path+".")
+		}
+	}
+}
+
+// ResponseWriter discarding a 404 response so it can be replaced
+type notFoundRecorder struct {
+	http.ResponseWriter
+	notFound bool
+}
+
+func (r *notFoundRecorder) WriteHeader(status int) {
+	if status == 404 {
+		r.notFound = true
+		return
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *notFoundRecorder) Write(b []byte) (int, error) {
+	if r.notFound {
+		return len(b), nil
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Error for the value a handler panicked with, which need not be an error
+func panicError(value interface{}) error {
+	if err, ok := value.(error); ok {
+		return err
+	}
+	return fmt.Errorf("panic: %v", value)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorResponses(t *testing.T) {
+	fmt.Println("Running Test: TestErrorResponses")
+
+	// Setup
+	datastore = NewMockDatastore()
+	config = Config{EmailThrottle: 5, PingPeriod: 60}
+	handler, key := buildTestHandler(), buildTestKey(ScopeAdmin, ScopeSend)
+
+	decode := func(res *httptest.ResponseRecorder) APIError {
+		var apiError APIError
+		if res.Header().Get("Content-Type") != "application/json" || json.Unmarshal(res.Body.Bytes(), &apiError) != nil {
+			t.Errorf("Error response %d is not JSON: %s", res.Code, res.Body.String())
+		}
+		if len(apiError.RequestId) == 0 || apiError.RequestId != res.Header().Get("X-Request-Id") {
+			t.Errorf("Error response has request ID %q, header %q", apiError.RequestId, res.Header().Get("X-Request-Id"))
+		}
+		return apiError
+	}
+
+	for _, test := range []struct {
+		method string
+		url    string
+		body   string
+		key    string
+		code   int
+		error  string
+	}{
+		{"GET", "/v1/status", "", "", 401, "unauthorized"},
+		{"GET", "/v1/nothing", "", key, 404, "not_found"},
+		{"DELETE", "/v1/status", "", key, 405, "method_not_allowed"},
+		{"POST", "/v1/contacts/", "{", key, 400, "bad_request"},
+		{"DELETE", "/v1/users/" + strings.Repeat("0", 24), "", key, 404, "not_found"},
+		{"POST", "/v1/providers/MailGun/restart", "", key, 404, "not_found"},
+		{"GET", "/resources/css/missing.css", "", "", 404, "not_found"},
+	} {
+		res := doAuthRequest(handler, test.method, test.url, test.body, test.key)
+		if res.Code != test.code {
+			t.Errorf("%s %s returned %d should be %d", test.method, test.url, res.Code, test.code)
+		}
+		if apiError := decode(res); apiError.Code != test.error || len(apiError.Message) == 0 {
+			t.Errorf("%s %s returned %+v should have code %s", test.method, test.url, apiError, test.error)
+		}
+	}
+
+	// Every invalid field is detailed
+	res := doAuthRequest(handler, "POST", "/v1/messages/", `{"to":["a@example.com","bad"],"from":"worse","subject":"Hi","text":"Hi"}`, key)
+	apiError := decode(res)
+	if res.Code != 400 || len(apiError.Details) != 2 || apiError.Details[0].Field != "to[1]" || apiError.Details[1].Field != "from" {
+		t.Errorf("Invalid message returned %d %+v", res.Code, apiError)
+	}
+
+	// A provider refusing the message
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(401)
+	}))
+	defer provider.Close()
+	Servers = map[MailSender]bool{&MailGunServer{MailServer{Name: "MailGun", Url: provider.URL + "/"}}: true}
+	initRateLimits()
+	initProviderLimits()
+	res = doAuthRequest(handler, "POST", "/v1/messages/", `{"to":["a@example.com"],"from":"me@example.com","subject":"Hi","text":"Hi"}`, key)
+	if apiError = decode(res); res.Code != 401 || apiError.Code != "unauthorized" || !strings.Contains(apiError.Message, "MailGun") {
+		t.Errorf("Provider rejection returned %d %+v", res.Code, apiError)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestPanicRecovery(t *testing.T) {
+	fmt.Println("Running Test: TestPanicRecovery")
+
+	for _, value := range []interface{}{errors.New("broken"), "broken", 42} {
+		panicking := errorHandler(func(w http.ResponseWriter, req *http.Request) {
+			panic(value)
+		})
+		res := doRequest(panicking, "GET", "/", "")
+		var apiError APIError
+		json.Unmarshal(res.Body.Bytes(), &apiError)
+		if res.Code != 500 || apiError.Code != "internal_server_error" || apiError.RequestId != res.Header().Get("X-Request-Id") {
+			t.Errorf("Panic with %#v returned %d %s", value, res.Code, res.Body.String())
+		}
+	}
+
+	// A response already started is left alone
+	started := errorHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(202)
+		panic("late")
+	})
+	res := doRequest(started, "GET", "/", "")
+	if res.Code != 202 || res.Body.Len() > 0 {
+		t.Errorf("Panic after the response started returned %d %s", res.Code, res.Body.String())
+	}
+
+	fmt.Println("Test Complete.")
+}
@@ -1,212 +1,1045 @@
 package main
 
 import (
+	"crypto/hmac"
 	"encoding/json"
 	"fmt"
 	"gopkg.in/mgo.v2/bson"
 	"html/template"
 	"io/ioutil"
 	"net/http"
-	"net/http/httputil"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// Handler for root resource, returns web page
+// Handler for root resource, returns web page for logged in users
 func rootHandler(w http.ResponseWriter, req *http.Request) {
+	identity, ok := authenticateSession(req)
+	if !ok {
+		http.Redirect(w, req, "/login", 302)
+		return
+	}
 	var rootTemplate, err = template.ParseFiles(indexHtml)
 	check(err)
-	rootTemplate.Execute(w, nil)
+	rootTemplate.Execute(w, struct {
+		Username  string
+		CsrfToken string
+	}{identity.Name, identity.csrfToken})
 }
 
-// Handler for Messages resource. Verfies received data and sends email
-func messageHandler(w http.ResponseWriter, req *http.Request) {
+// Handler for the login page. The form is protected by a double submit
+// CSRF cookie since there is no session yet
+func loginHandler(w http.ResponseWriter, req *http.Request) {
 
-	// Parse Data
-	if req.Method == "POST" {
+	renderLogin := func(status int, message string) {
+		csrfToken := randomToken()
+		setCookie(w, req, csrfCookie, csrfToken, time.Now().Add(time.Hour))
+		loginTemplate, err := template.ParseFiles(loginHtml)
+		check(err)
+		w.WriteHeader(status)
+		loginTemplate.Execute(w, struct {
+			Error     string
+			CsrfToken string
+			OIDCName  string
+		}{message, csrfToken, oidcName()})
+	}
 
-		values := req.URL.Query()
-		password := values.Get("password")
-		if password != Password {
-			w.WriteHeader(403)
+	switch req.Method {
+	case "GET":
+		renderLogin(200, "")
+	case "POST":
+		cookie, err := req.Cookie(csrfCookie)
+		if err != nil || !validCsrfToken(req, cookie.Value) {
+			renderLogin(403, "Your session expired, please try again.")
 			return
 		}
-
-		// Build Message
-		bytes, err := ioutil.ReadAll(req.Body)
-		check(err)
-		var email Message
-		err = json.Unmarshal(bytes, &email)
+		user, err := requestStore(req).RetrieveUser(req.FormValue("username"))
 		if err != nil {
-			http.Error(w, "Invalid JSON", 400)
+			checkPassword(string(dummyPasswordHash), req.FormValue("password"))
+			renderLogin(401, "Invalid username or password.")
 			return
 		}
-
-		// Validate Fields
-		for _, to := range email.To {
-			matchTo, _ := regexp.MatchString(emailRegex, to)
-			if !matchTo {
-				if Debug {
-					ErrorLog.Println("To address not valid email: " + to)
-				}
-				http.Error(w, "Invalid 'To' Email Address.", 400)
-				return
-			}
+		if !checkPassword(user.PasswordHash, req.FormValue("password")) {
+			renderLogin(401, "Invalid username or password.")
+			return
 		}
-		matchFrom, _ := regexp.MatchString(emailRegex, email.From)
-		if !matchFrom {
-			if Debug {
-				ErrorLog.Println("From address not valid email.")
-			}
-			http.Error(w, "Invalid 'From' Email Address.", 400)
+		session, token := newSession(user)
+		err = requestStore(req).StoreSession(session)
+		if err != nil {
+			requestLog(req).Error("Error storing session", "error", err)
+			renderLogin(500, "Could not log in, please try again.")
 			return
 		}
+		requestLog(req).Info("User logged in", "user", user.Username)
+		setCookie(w, req, sessionCookie, token, session.Expires)
+		setCookie(w, req, csrfCookie, "", time.Unix(0, 0))
+		http.Redirect(w, req, "/", 303)
+	}
+}
 
-		sender := chooseMailSender()
-		if sender == nil {
-			http.Error(w, "No Mail Server Available.", 500)
-			return
+// Handler starting an OpenID Connect sign-in
+func oidcLoginHandler(w http.ResponseWriter, req *http.Request) {
+	if !oidcEnabled() {
+		writeError(w, req, 404, "OpenID Connect sign-in is not configured.")
+		return
+	}
+	provider, err := discoverOIDC()
+	if err != nil {
+		requestLog(req).Error("OIDC discovery failed", "error", err)
+		writeError(w, req, 502, "Sign-in provider unavailable.")
+		return
+	}
+	authUrl, pending := oidcAuthorizationUrl(provider)
+	setCookie(w, req, oidcCookie, pending, time.Now().Add(10*time.Minute))
+	http.Redirect(w, req, authUrl, 302)
+}
+
+// Handler for the OpenID Connect redirect back from the issuer
+func oidcCallbackHandler(w http.ResponseWriter, req *http.Request) {
+	if !oidcEnabled() {
+		writeError(w, req, 404, "OpenID Connect sign-in is not configured.")
+		return
+	}
+	values := req.URL.Query()
+	if len(values.Get("error")) > 0 {
+		writeError(w, req, 401, "Sign-in failed: "+values.Get("error"))
+		return
+	}
+
+	// Pending sign-in is state.nonce.verifier
+	cookie, err := req.Cookie(oidcCookie)
+	if err != nil {
+		writeError(w, req, 400, "Sign-in expired, please try again.")
+		return
+	}
+	setCookie(w, req, oidcCookie, "", time.Unix(0, 0))
+	pending := strings.Split(cookie.Value, ".")
+	if len(pending) != 3 || !hmac.Equal([]byte(pending[0]), []byte(values.Get("state"))) {
+		writeError(w, req, 400, "Invalid sign-in state.")
+		return
+	}
+
+	provider, err := discoverOIDC()
+	if err != nil {
+		requestLog(req).Error("OIDC discovery failed", "error", err)
+		writeError(w, req, 502, "Sign-in provider unavailable.")
+		return
+	}
+	claims, err := oidcExchange(provider, values.Get("code"), pending[2], pending[1])
+	if err != nil {
+		requestLog(req).Warn("OIDC sign-in failed", "error", err)
+		writeError(w, req, 401, "Sign-in failed.")
+		return
+	}
+	user, err := oidcUser(requestStore(req), claims)
+	if err != nil {
+		requestLog(req).Warn("OIDC user mapping failed", "error", err)
+		writeError(w, req, 403, "Sign-in failed.")
+		return
+	}
+
+	session, token := newSession(user)
+	err = requestStore(req).StoreSession(session)
+	if err != nil {
+		requestLog(req).Error("Error storing session", "error", err)
+		writeError(w, req, 500, "Could not log in, please try again.")
+		return
+	}
+	requestLog(req).Info("User logged in via OIDC", "user", user.Username)
+	setCookie(w, req, sessionCookie, token, session.Expires)
+	http.Redirect(w, req, "/", 303)
+}
+
+// Handler to end the current session
+func logoutHandler(w http.ResponseWriter, req *http.Request) {
+	if session, ok := requestSession(req); ok {
+		requestStore(req).DeleteSession(session.Id)
+	}
+	setCookie(w, req, sessionCookie, "", time.Unix(0, 0))
+	http.Redirect(w, req, "/login", 303)
+}
+
+// Handler for Messages resource. Verfies received data and sends email
+func messageHandler(w http.ResponseWriter, req *http.Request) {
+
+	// Build Message
+	bytes, err := ioutil.ReadAll(req.Body)
+	check(err)
+	var email Message
+	err = json.Unmarshal(bytes, &email)
+	if err != nil {
+		writeError(w, req, 400, "Invalid JSON")
+		return
+	}
+
+	// Validate Fields
+	ctx := req.Context()
+	store := requestStore(req)
+	_, validate := startSpan(ctx, "validate message", SpanKindInternal, "recipients", len(email.To))
+	invalid := []FieldError{}
+	for i, to := range email.To {
+		matchTo, _ := regexp.MatchString(emailRegex, to)
+		if !matchTo {
+			requestLog(req).Debug("To address not valid email", "to", to)
+			invalid = append(invalid, FieldError{fmt.Sprintf("to[%d]", i), "Invalid Email Address."})
 		}
-		if !requestSlot() {
-			http.Error(w, "Over throttle limit.", 403)
+	}
+	matchFrom, _ := regexp.MatchString(emailRegex, email.From)
+	if !matchFrom {
+		requestLog(req).Debug("From address not valid email", "from", email.From)
+		invalid = append(invalid, FieldError{"from", "Invalid Email Address."})
+	}
+	allowed := requestIdentity(req).CanSendFrom(email.From)
+	validate.End()
+	if len(invalid) > 0 {
+		writeError(w, req, 400, "Invalid message.", invalid...)
+		return
+	}
+	if !allowed {
+		writeError(w, req, 403, "Not allowed to send from "+email.From+".")
+		return
+	}
+
+	// Drop suppressed recipients before choosing a Mail Server
+	_, suppression := startSpan(ctx, "filter suppressed", SpanKindInternal)
+	email, suppressed, err := filterSuppressed(store, email)
+	if err != nil {
+		// Never mail an address we could not check
+		suppression.SetError(err)
+		suppression.End()
+		requestLog(req).Error("Error checking Suppression", "error", err)
+		writeError(w, req, 503, "Could not check suppressed recipients.")
+		return
+	}
+	suppression.SetAttributes("suppressed", len(suppressed))
+	suppression.End()
+	if len(suppressed) > 0 {
+		requestLog(req).Debug("Skipping suppressed recipients", "recipients", suppressed)
+	}
+	if len(email.To) == 0 {
+		writeError(w, req, 422, "All recipients are suppressed.")
+		return
+	}
+
+	// Render per recipient templates from contact details
+	_, personalize := startSpan(ctx, "personalize message", SpanKindInternal)
+	messages, err := personalizeMessage(store, email)
+	personalize.End()
+	if err != nil {
+		writeError(w, req, 400, "Invalid message template: "+err.Error())
+		return
+	}
+	messages = addUnsubscribeHeaders(messages)
+
+	identity := requestIdentity(req)
+	_, throttle := startSpan(ctx, "rate limit", SpanKindInternal)
+	limit := takeRateLimits(identity, clientIP(req), email.From, len(messages))
+	throttle.SetAttributes("allowed", limit.allowed, "limit", limit.name)
+	throttle.End()
+	setRateLimitHeaders(w, limit)
+	if !limit.allowed {
+		requestLog(req).Info("Request blocked. Rate limit exceeded", "limit", limit.name)
+		throttleRejections.Inc(limit.name)
+		writeError(w, req, 429, "Rate limit exceeded.")
+		return
+	}
+	messagesAccepted.Add(float64(len(messages)))
+	_, selection := startSpan(ctx, "select provider", SpanKindInternal)
+	sender := chooseMailSender(ctx, len(messages))
+	selection.End()
+	if sender == nil {
+		writeError(w, req, 500, "No Mail Server Available.")
+		return
+	}
+	if !reserveProviderSends(sender.GetName(), len(messages)) {
+		writeError(w, req, 503, sender.GetName()+" is over its quota.")
+		return
+	}
+	beginSend(sender.GetName())
+	defer endSend(sender.GetName())
+	status := 200
+	for i, message := range messages {
+		if !paceProviderSend(ctx, sender.GetName()) {
+			releaseProviderSends(sender.GetName(), len(messages)-i)
+			writeError(w, req, 503, fmt.Sprintf("Sending interrupted after %d of %d messages.", i, len(messages)))
 			return
 		}
-		status := sender.Send(email)
-		w.WriteHeader(status)
+		start := time.Now()
+		sendCtx, send := startSpan(ctx, "send message", SpanKindInternal, "provider", sender.GetName())
+		s := sender.Send(sendCtx, message)
+		send.SetHTTPStatus(s)
+		send.End()
+		sendLatency.Since(start, sender.GetName())
+		recordSendResult(sender.GetName(), s)
+		if s < 200 || s > 299 {
+			status = s
+			releaseProviderSends(sender.GetName(), 1)
+			messagesFailed.Inc(sender.GetName(), strconv.Itoa(s))
+		} else {
+			messagesSent.Inc(sender.GetName(), strconv.Itoa(s))
+			recordProviderSend(ctx, store, sender.GetName())
+		}
+		if len(identity.UserId) > 0 {
+			recordSend(ctx, store, identity, message, sender, s)
+		}
+	}
+	if status != 200 {
+		writeError(w, req, status, sender.GetName()+" rejected the message.")
 		return
 	}
-
-	// Other methods not supported
-	w.WriteHeader(405)
+	w.WriteHeader(status)
 }
 
 // Handler to return status of MailServers
 func statusHandler(w http.ResponseWriter, req *http.Request) {
 
-	result := make(map[string]bool)
-	for s, b := range Servers {
-		result[s.GetName()] = b
+	result := make(map[string]Status)
+	for s, up := range serverStatuses() {
+		result[s.GetName()] = providerStatus(s.GetName(), up)
 	}
 	statusJson, err := json.Marshal(result)
 	check(err)
 
-	fmt.Fprintf(w, string(statusJson))
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", statusJson)
 }
 
-func contactsHandler(w http.ResponseWriter, req *http.Request) {
-
+// Handler listing contacts, filtered by the id, tag, name or a custom
+// field in the query. GET /contacts/{id} returns just that contact
+func getContactsHandler(w http.ResponseWriter, req *http.Request) {
 	values := req.URL.Query()
-	id := values.Get("id")
+	id := contactId(req)
 	tag := values.Get("tag")
 	name := values.Get("name")
 
-	path := req.URL.Path
-	pieces := strings.Split(path, "/")
+	requestLog(req).Debug("Get Contact", "id", id)
+	var contacts []Contact
+	if len(id) > 0 {
+		contacts = requestStore(req).RetrieveContactsBy("id", id)
+		if len(contacts) == 0 {
+			writeContactError(w, req, ErrContactNotFound)
+			return
+		}
+		setContactETag(w, contacts[0])
+	} else if len(tag) > 0 {
+		contacts = requestStore(req).RetrieveContactsBy("tag", tag)
+	} else if len(name) > 0 {
+		contacts = requestStore(req).RetrieveContactsBy("name", name)
+	} else if field, value := fieldFilter(values); len(field) > 0 {
+		contacts = requestStore(req).RetrieveContactsBy("fields."+field, value)
+	} else {
+		// Fetch All
+	}
 
-	// If ID is in Path it takes precedence
-	if len(pieces) > 2 && len(pieces[2]) > 0 {
-		id = pieces[2]
+	jsonContacts, err := json.Marshal(contacts)
+	if err != nil {
+		requestLog(req).Error("Error marshalling Contacts", "error", err)
+		writeError(w, req, 500, "Could not list contacts.")
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "%s", jsonContacts)
+}
 
-	if len(id) > 0 {
-		if !bson.IsObjectIdHex(id) {
-			w.WriteHeader(404)
+func createContactHandler(w http.ResponseWriter, req *http.Request) {
+	requestLog(req).Debug("Create Contact")
+	bytes, err := ioutil.ReadAll(req.Body)
+	check(err)
+	var contact Contact
+	err = json.Unmarshal(bytes, &contact)
+	if err != nil {
+		writeError(w, req, 400, "Invalid JSON")
+		return
+	}
+	result, err := requestStore(req).StoreContact(contact)
+	if err != nil {
+		writeContactError(w, req, err)
+		return
+	}
+	writeContact(w, result)
+}
+
+// Handler merging the contact given by ?source= into the contact
+func mergeContactHandler(w http.ResponseWriter, req *http.Request) {
+	id := contactId(req)
+	source := req.URL.Query().Get("source")
+	requestLog(req).Debug("Merge Contact", "id", id, "source", source)
+	if !bson.IsObjectIdHex(source) || source == id {
+		writeError(w, req, 400, "Invalid merge source.", FieldError{"source", "Must be the ID of another contact."})
+		return
+	}
+	result, err := requestStore(req).MergeContacts(id, source)
+	if err != nil {
+		writeContactError(w, req, err)
+		return
+	}
+	writeContact(w, result)
+}
+
+func updateContactHandler(w http.ResponseWriter, req *http.Request) {
+	id := contactId(req)
+	requestLog(req).Debug("Update Contact", "id", id)
+	current, ok := currentContact(w, req, id)
+	if !ok {
+		return
+	}
+	bytes, err := ioutil.ReadAll(req.Body)
+	check(err)
+	var contact Contact
+	err = json.Unmarshal(bytes, &contact)
+	if err != nil {
+		writeError(w, req, 400, "Invalid JSON")
+		return
+	}
+	contact.Id = current.Id
+	contact.Version = current.Version
+	result, err := requestStore(req).UpdateContact(contact)
+	if err != nil {
+		writeContactError(w, req, err)
+		return
+	}
+	writeContact(w, result)
+}
+
+// Handler applying a JSON Merge Patch to a contact
+func patchContactHandler(w http.ResponseWriter, req *http.Request) {
+	id := contactId(req)
+	requestLog(req).Debug("Patch Contact", "id", id)
+	current, ok := currentContact(w, req, id)
+	if !ok {
+		return
+	}
+	bytes, err := ioutil.ReadAll(req.Body)
+	check(err)
+	contact, err := applyContactPatch(current, bytes)
+	if err != nil {
+		writeError(w, req, 400, "Invalid JSON Merge Patch")
+		return
+	}
+	result, err := requestStore(req).UpdateContact(contact)
+	if err != nil {
+		writeContactError(w, req, err)
+		return
+	}
+	writeContact(w, result)
+}
+
+func deleteContactHandler(w http.ResponseWriter, req *http.Request) {
+	id := contactId(req)
+	requestLog(req).Debug("Delete Contact", "id", id)
+	if requestStore(req).DeleteContact(id) {
+		w.WriteHeader(200)
+	} else {
+		requestLog(req).Debug("Could not delete contact", "id", id)
+		writeError(w, req, 404, "Contact not found.")
+	}
+}
+
+func addContactTagHandler(w http.ResponseWriter, req *http.Request) {
+	id, tag := contactId(req), pathParam(req, "tag")
+	requestLog(req).Debug("Add Contact Tag", "id", id, "tag", tag)
+	result, err := requestStore(req).AddContactTag(id, tag)
+	if err != nil {
+		writeContactError(w, req, err)
+		return
+	}
+	writeContact(w, result)
+}
+
+func removeContactTagHandler(w http.ResponseWriter, req *http.Request) {
+	id, tag := contactId(req), pathParam(req, "tag")
+	requestLog(req).Debug("Remove Contact Tag", "id", id, "tag", tag)
+	result, err := requestStore(req).RemoveContactTag(id, tag)
+	if err != nil {
+		writeContactError(w, req, err)
+		return
+	}
+	writeContact(w, result)
+}
+
+// Handler listing the Suppression list, or with an email in the path the
+// one entry. Addresses on the list are never mailed
+func getSuppressionsHandler(w http.ResponseWriter, req *http.Request) {
+	email := strings.ToLower(pathParam(req, "email"))
+	var result interface{}
+	if len(email) > 0 {
+		suppression, err := requestStore(req).RetrieveSuppression(email)
+		if err == ErrSuppressionNotFound {
+			writeError(w, req, 404, "Suppression not found.")
+			return
+		}
+		if err != nil {
+			requestLog(req).Error("Error retrieving Suppression", "email", email, "error", err)
+			writeError(w, req, 503, "Could not retrieve Suppression.")
 			return
 		}
+		result = suppression
+	} else {
+		result = requestStore(req).RetrieveSuppressions()
 	}
+	jsonResult, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "%s", jsonResult)
+}
 
-	switch req.Method {
-	case "GET":
-		if Debug {
-			InfoLog.Println("Get Contact")
-		}
-		var contacts []Contact
-		if len(id) > 0 {
-			contacts = datastore.RetrieveContactsBy("id", id)
-		} else if len(tag) > 0 {
-			contacts = datastore.RetrieveContactsBy("tag", tag)
-		} else if len(name) > 0 {
-			contacts = datastore.RetrieveContactsBy("name", name)
-		} else {
-			// Fetch All
+func createSuppressionHandler(w http.ResponseWriter, req *http.Request) {
+	bytes, err := ioutil.ReadAll(req.Body)
+	check(err)
+	var suppression Suppression
+	err = json.Unmarshal(bytes, &suppression)
+	if err != nil {
+		writeError(w, req, 400, "Invalid JSON")
+		return
+	}
+	if len(suppression.Source) == 0 {
+		suppression.Source = "api"
+	}
+	result, err := requestStore(req).StoreSuppression(suppression)
+	if err != nil {
+		writeContactError(w, req, err)
+		return
+	}
+	jsonResult, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "%s", jsonResult)
+}
+
+func deleteSuppressionHandler(w http.ResponseWriter, req *http.Request) {
+	if requestStore(req).DeleteSuppression(strings.ToLower(pathParam(req, "email"))) {
+		w.WriteHeader(200)
+	} else {
+		writeError(w, req, 404, "Suppression not found.")
+	}
+}
+
+// Handler listing API keys, never with their plaintext
+func getAPIKeysHandler(w http.ResponseWriter, req *http.Request) {
+	jsonKeys, _ := json.Marshal(requestStore(req).RetrieveAPIKeys())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "%s", jsonKeys)
+}
+
+// Handler creating an API key. The plaintext key is only returned here
+func createAPIKeyHandler(w http.ResponseWriter, req *http.Request) {
+	bytes, err := ioutil.ReadAll(req.Body)
+	check(err)
+	var request struct {
+		Name        string   `json:"name"`
+		Scopes      []string `json:"scopes"`
+		AllowedFrom []string `json:"allowedFrom"`
+	}
+	err = json.Unmarshal(bytes, &request)
+	if err != nil {
+		writeError(w, req, 400, "Invalid JSON")
+		return
+	}
+	if !validateScopes(request.Scopes) {
+		writeError(w, req, 400, "Invalid scopes.", FieldError{"scopes", "Must be one or more of " + strings.Join(validScopes, ", ") + "."})
+		return
+	}
+	key, plaintext := newAPIKey(request.Name, request.Scopes)
+	key.AllowedFrom = request.AllowedFrom
+	key, err = requestStore(req).StoreAPIKey(key)
+	if err != nil {
+		requestLog(req).Error("Error storing API key", "error", err)
+		writeError(w, req, 500, "Could not create API key.")
+		return
+	}
+	jsonKey, _ := json.Marshal(struct {
+		APIKey
+		Key string `json:"key"`
+	}{key, plaintext})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	fmt.Fprintf(w, "%s", jsonKey)
+}
+
+func revokeAPIKeyHandler(w http.ResponseWriter, req *http.Request) {
+	id := pathParam(req, "id")
+	if bson.IsObjectIdHex(id) && requestStore(req).RevokeAPIKey(id) {
+		w.WriteHeader(200)
+	} else {
+		writeError(w, req, 404, "API key not found.")
+	}
+}
+
+// Handler listing Mail Server configuration. API keys are never returned
+func getProvidersHandler(w http.ResponseWriter, req *http.Request) {
+	type provider struct {
+		Name   string `json:"name"`
+		Url    string `json:"url"`
+		HasKey bool   `json:"hasKey"`
+		Up     bool   `json:"up"`
+		Mode   string `json:"mode"`
+	}
+	result := []provider{}
+	for _, conf := range mailServerConfigs() {
+		up := false
+		for s, status := range serverStatuses() {
+			if s.GetName() == conf.Name {
+				up = status
+			}
 		}
+		result = append(result, provider{conf.Name, conf.Url, len(conf.ApiKey) > 0, up, providerOverride(conf.Name).Mode})
+	}
+	jsonResult, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "%s", jsonResult)
+}
 
-		jsonContacts, err := json.Marshal(contacts)
-		if err != nil {
-			ErrorLog.Println("Error marshalling Contacts.")
-			w.WriteHeader(400)
+// Handler changing a Mail Server's url or apiKey
+func updateProviderHandler(w http.ResponseWriter, req *http.Request) {
+	name := pathParam(req, "name")
+	bytes, err := ioutil.ReadAll(req.Body)
+	check(err)
+	var update struct {
+		Url    *string `json:"url"`
+		ApiKey *string `json:"apiKey"`
+	}
+	err = json.Unmarshal(bytes, &update)
+	if err != nil {
+		writeError(w, req, 400, "Invalid JSON")
+		return
+	}
+	found := false
+	for _, conf := range currentConfig().MailServers {
+		if conf.Name == name {
+			found = true
+		}
+	}
+	if !found {
+		writeError(w, req, 404, "Mail Server not found.")
+		return
+	}
+	// References would let a caller read local secrets and send them to
+	// the url, they only come from the config
+	if update.ApiKey != nil && isSecretReference(*update.ApiKey) {
+		writeError(w, req, 400, "Invalid apiKey.", FieldError{"apiKey", "Secret references are only allowed in the config."})
+		return
+	}
+	// Keys are stored encrypted, never in plain text
+	if update.ApiKey != nil && len(*update.ApiKey) > 0 && len(currentConfig().ProviderKeySecret) == 0 {
+		writeError(w, req, 400, "Invalid apiKey.", FieldError{"apiKey", "Set providerKeySecret in the config to store apiKeys."})
+		return
+	}
+
+	// Stored with the override so it is applied again on reload, and
+	// serialized with reloads rebuilding the Mail Servers
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	override := providerOverride(name)
+	if update.Url != nil {
+		override.Url = *update.Url
+	}
+	if update.ApiKey != nil {
+		override.ApiKey = *update.ApiKey
+		override.SealedKey = ""
+		if len(override.ApiKey) > 0 {
+			override.SealedKey, err = sealProviderKey(name, override.ApiKey)
+		}
+	}
+	override.UpdatedBy = requestIdentity(req).Name
+	if err == nil {
+		err = setProviderOverride(override)
+	}
+	if err != nil {
+		requestLog(req).Error("Error storing provider override", "error", err)
+		writeError(w, req, 500, "Could not change Mail Server.")
+		return
+	}
+	requestLog(req).Info("Mail Server configuration changed", "provider", name, "client", override.UpdatedBy)
+	buildServersMap()
+	w.WriteHeader(200)
+}
+
+// Actions on a single Mail Server: POST /providers/{name}/ping checks it
+// now, enable, disable, drain and auto set its override
+func providerActionHandler(w http.ResponseWriter, req *http.Request) {
+	name, action := pathParam(req, "name"), pathParam(req, "action")
+	found := false
+	for _, conf := range currentConfig().MailServers {
+		if conf.Name == name {
+			found = true
+		}
+	}
+	if !found {
+		writeError(w, req, 404, "Mail Server not found.")
+		return
+	}
+
+	modes := map[string]string{
+		"enable":  ProviderEnabled,
+		"disable": ProviderDisabled,
+		"drain":   ProviderDraining,
+		"auto":    ProviderAuto,
+	}
+	if action == "ping" {
+		if _, ok := pingProvider(name); !ok {
+			writeError(w, req, 404, "Mail Server not running.")
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(200)
-		fmt.Fprintf(w, "%s", jsonContacts)
-	case "POST":
-		if Debug {
-			InfoLog.Println("Create Contact")
+	} else if mode, ok := modes[action]; ok {
+		var body struct {
+			Reason string `json:"reason"`
 		}
 		bytes, err := ioutil.ReadAll(req.Body)
 		check(err)
-		var contact Contact
-		err = json.Unmarshal(bytes, &contact)
+		if len(bytes) > 0 && json.Unmarshal(bytes, &body) != nil {
+			writeError(w, req, 400, "Invalid JSON")
+			return
+		}
+		override := providerOverride(name)
+		override.Mode, override.Reason, override.UpdatedBy = mode, body.Reason, requestIdentity(req).Name
+		err = setProviderOverride(override)
 		if err != nil {
-			http.Error(w, "Invalid JSON", 400)
+			requestLog(req).Error("Error storing provider override", "error", err)
+			writeError(w, req, 500, "Could not change Mail Server.")
 			return
 		}
-		result := datastore.StoreContact(contact)
-		jsonContact, _ := json.Marshal(result)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(200)
-		fmt.Fprintf(w, "%s", jsonContact)
-	case "PUT":
-		if Debug {
-			InfoLog.Println("Update Contact")
+		requestLog(req).Info("Mail Server override changed", "provider", name, "mode", mode, "reason", body.Reason, "client", override.UpdatedBy)
+	} else {
+		writeError(w, req, 404, "Unknown Mail Server action "+action+".")
+		return
+	}
+
+	up := false
+	for s, status := range serverStatuses() {
+		if s.GetName() == name {
+			up = status
 		}
+	}
+	jsonStatus, _ := json.Marshal(providerStatus(name, up))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "%s", jsonStatus)
+}
+
+// Read or change the log level at runtime
+func logLevelHandler(w http.ResponseWriter, req *http.Request) {
+	var level struct {
+		Level string `json:"level"`
+	}
+
+	switch req.Method {
+	case "GET":
+	case "PUT":
 		bytes, err := ioutil.ReadAll(req.Body)
 		check(err)
-		var contact Contact
-		err = json.Unmarshal(bytes, &contact)
+		err = json.Unmarshal(bytes, &level)
 		if err != nil {
-			http.Error(w, "Invalid JSON", 400)
+			writeError(w, req, 400, "Invalid JSON")
 			return
 		}
-		result := datastore.UpdateContact(contact)
-		jsonContact, _ := json.Marshal(result)
-		w.Header().Set("Content-Type", "application/json")
+		parsed, err := parseLogLevel(level.Level)
+		if err != nil {
+			writeError(w, req, 400, "Invalid log level.", FieldError{"level", "Must be debug, info, warn or error."})
+			return
+		}
+		setLogLevel(parsed)
+		requestLog(req).Info("Log level changed", "level", parsed, "client", requestIdentity(req).Name)
+	}
+	level.Level = currentLogLevel().String()
+	jsonLevel, _ := json.Marshal(level)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "%s", jsonLevel)
+}
+
+// Handler listing User accounts
+func getUsersHandler(w http.ResponseWriter, req *http.Request) {
+	jsonUsers, _ := json.Marshal(requestStore(req).RetrieveUsers())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "%s", jsonUsers)
+}
+
+func createUserHandler(w http.ResponseWriter, req *http.Request) {
+	bytes, err := ioutil.ReadAll(req.Body)
+	check(err)
+	var request struct {
+		Username string   `json:"username"`
+		Password string   `json:"password"`
+		Roles    []string `json:"roles"`
+	}
+	err = json.Unmarshal(bytes, &request)
+	if err != nil {
+		writeError(w, req, 400, "Invalid JSON")
+		return
+	}
+	if len(request.Password) < 8 {
+		writeError(w, req, 400, "Invalid user.", FieldError{"password", "Must be at least 8 characters."})
+		return
+	}
+	hash, err := hashPassword(request.Password)
+	check(err)
+	user := User{
+		Id:           bson.NewObjectId(),
+		Username:     request.Username,
+		PasswordHash: hash,
+		Roles:        request.Roles,
+		Created:      time.Now().UTC(),
+	}
+	user, err = requestStore(req).StoreUser(user)
+	switch err {
+	case nil:
+	case ErrInvalidUser:
+		writeError(w, req, 400, "Invalid username or roles.")
+		return
+	case ErrDuplicateUser:
+		writeError(w, req, 409, "Username already in use.")
+		return
+	default:
+		requestLog(req).Error("Error storing user", "error", err)
+		writeError(w, req, 500, "Could not create user.")
+		return
+	}
+	jsonUser, _ := json.Marshal(user)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	fmt.Fprintf(w, "%s", jsonUser)
+}
+
+func deleteUserHandler(w http.ResponseWriter, req *http.Request) {
+	id := pathParam(req, "id")
+	if bson.IsObjectIdHex(id) && requestStore(req).DeleteUser(id) {
 		w.WriteHeader(200)
-		fmt.Fprintf(w, "%s", jsonContact)
-	case "DELETE":
-		if Debug {
-			InfoLog.Println("Delete Contact")
+	} else {
+		writeError(w, req, 404, "User not found.")
+	}
+}
+
+// Handler returning the messages sent by the logged in user
+func historyHandler(w http.ResponseWriter, req *http.Request) {
+	records := []SendRecord{}
+	identity := requestIdentity(req)
+	if len(identity.UserId) > 0 {
+		records = requestStore(req).RetrieveSendRecords(identity.UserId.Hex())
+	}
+	jsonRecords, _ := json.Marshal(records)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "%s", jsonRecords)
+}
+
+// Handler for signed unsubscribe links. GET shows a confirmation page,
+// POST (including RFC 8058 one-click requests) suppresses the address
+func unsubscribeHandler(w http.ResponseWriter, req *http.Request) {
+
+	values := req.URL.Query()
+	email := strings.ToLower(values.Get("email"))
+	if !validUnsubscribeSignature(email, values.Get("sig")) {
+		writeError(w, req, 403, "Invalid unsubscribe link.")
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		unsubscribeTemplate, err := template.ParseFiles(unsubscribeHtml)
+		check(err)
+		unsubscribeTemplate.Execute(w, struct {
+			Email        string
+			Action       string
+			Unsubscribed bool
+		}{email, req.URL.String(), false})
+	case "POST":
+		source := "link"
+		if req.FormValue("List-Unsubscribe") == "One-Click" {
+			source = "one-click"
 		}
-		if datastore.DeleteContact(id) {
+		_, err := requestStore(req).StoreSuppression(Suppression{Email: email, Reason: "unsubscribe", Source: source})
+		if err != nil {
+			writeContactError(w, req, err)
+			return
+		}
+		if source == "one-click" {
 			w.WriteHeader(200)
-		} else {
-			if Debug {
-				InfoLog.Println("Could not delete contact:  " + id)
+			return
+		}
+		unsubscribeTemplate, err := template.ParseFiles(unsubscribeHtml)
+		check(err)
+		unsubscribeTemplate.Execute(w, struct {
+			Email        string
+			Action       string
+			Unsubscribed bool
+		}{email, "", true})
+	}
+}
+
+// Find a custom field filter in the query, e.g. ?fields.plan=pro
+func fieldFilter(values url.Values) (string, string) {
+	for key := range values {
+		if strings.HasPrefix(key, "fields.") {
+			field := strings.TrimPrefix(key, "fields.")
+			if fieldNameRegex.MatchString(field) {
+				return field, values.Get(key)
 			}
-			w.WriteHeader(404)
 		}
+	}
+	return "", ""
+}
+
+// Wrap a contact handler, counting its requests under operation in the
+// metrics. Malformed contact IDs get 404
+func contactRoute(operation string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: 200}
+		defer func() {
+			contactOperations.Inc(operation, strconv.Itoa(recorder.status))
+		}()
+		if id := contactId(req); len(id) > 0 && !bson.IsObjectIdHex(id) {
+			writeError(recorder, req, 404, "Contact not found.")
+			return
+		}
+		fn(recorder, req)
+	}
+}
+
+// ID of the contact addressed by the path, or by ?id= on the collection
+func contactId(req *http.Request) string {
+	if id := pathParam(req, "id"); len(id) > 0 {
+		return id
+	}
+	return req.URL.Query().Get("id")
+}
+
+// Fetch the contact being modified and resolve the version the client
+// expects from If-Match. Writes the error response and returns false if
+// the contact does not exist or the precondition cannot be met
+func currentContact(w http.ResponseWriter, req *http.Request, id string) (Contact, bool) {
+	if len(id) == 0 {
+		writeContactError(w, req, ErrContactNotFound)
+		return Contact{}, false
+	}
+	contacts := requestStore(req).RetrieveContactsBy("id", id)
+	if len(contacts) == 0 {
+		writeContactError(w, req, ErrContactNotFound)
+		return Contact{}, false
+	}
+	contact := contacts[0]
+
+	ifMatch := req.Header.Get("If-Match")
+	if len(ifMatch) == 0 || ifMatch == "*" {
+		return contact, true
+	}
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`))
+	if err != nil || version != contact.Version {
+		writeContactError(w, req, ErrVersionConflict)
+		return Contact{}, false
+	}
+	return contact, true
+}
+
+// Set the ETag header from the contact version
+func setContactETag(w http.ResponseWriter, contact Contact) {
+	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, contact.Version))
+}
+
+// Write a single contact as JSON along with its ETag
+func writeContact(w http.ResponseWriter, contact Contact) {
+	jsonContact, _ := json.Marshal(contact)
+	setContactETag(w, contact)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "%s", jsonContact)
+}
+
+// Handler exposing all metrics for Prometheus to scrape
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metricsRegistry {
+		m.write(w)
+	}
+}
+
+// Liveness probe, the process is up and serving
+func healthzHandler(w http.ResponseWriter, req *http.Request) {
+	report := healthReport{Status: "ok", Uptime: time.Since(startTime).Round(time.Second).String()}
+	jsonReport, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "%s", jsonReport)
+}
+
+// Readiness probe, 503 while this instance cannot send mail
+func readyzHandler(w http.ResponseWriter, req *http.Request) {
+	report, ready := checkReadiness()
+	jsonReport, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if ready {
+		w.WriteHeader(200)
+	} else {
+		w.WriteHeader(503)
+	}
+	fmt.Fprintf(w, "%s", jsonReport)
+}
+
+// Map Datastore contact errors to HTTP responses
+func writeContactError(w http.ResponseWriter, req *http.Request, err error) {
+	switch err {
+	case ErrInvalidEmail:
+		writeError(w, req, 400, "Invalid contact.", FieldError{"email", "Invalid Email Address."})
+	case ErrDuplicateEmail:
+		writeError(w, req, 409, "Email Address already in use.")
+	case ErrContactNotFound:
+		writeError(w, req, 404, "Contact not found.")
+	case ErrInvalidField:
+		writeError(w, req, 400, "Invalid contact.", FieldError{"fields", "Names must start with a letter followed by letters, digits or underscores, values must be strings, numbers, booleans or RFC 3339 dates."})
+	case ErrVersionConflict:
+		writeError(w, req, 412, "Contact has been modified.")
 	default:
-		w.WriteHeader(405)
+		requestLog(req).Error("Contact operation failed", "error", err)
+		writeError(w, req, 500, "Contact operation failed.")
 	}
 }
 
-// Error Handler Wrapper
+// Error Handler Wrapper. Tags the request with an ID, echoed in the
+// X-Request-Id header, traces it as a child of any caller's trace and
+// logs it once handled. A panic becomes a 500 error response unless the
+// handler had already started its response
 func errorHandler(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		if Debug {
-			InfoLog.Println(time.Now().String())
-			reqDump, _ := httputil.DumpRequest(req, true)
-			InfoLog.Printf("Request: %s\n\n", reqDump)
-		}
+		start := time.Now()
+		id := newRequestId(req)
+		ctx, span := startSpan(extractTraceContext(req), requestSpanName(req), SpanKindServer,
+			"http.request.method", req.Method, "url.path", req.URL.Path, "request_id", id)
+		req = withRequestId(req.WithContext(ctx), id)
+		w.Header().Set("X-Request-Id", id)
+		logger := requestLog(req)
+		logRequestBody(req)
+		recorder := &statusRecorder{ResponseWriter: w, status: 200}
 		defer func() {
-			if e, ok := recover().(error); ok {
-				w.WriteHeader(500)
-				ErrorLog.Print("error: ")
-				ErrorLog.Println(e)
+			if value := recover(); value != nil {
+				e := panicError(value)
+				logger.Error("Request failed", "error", e)
+				span.SetError(e)
+				if !recorder.wroteHeader {
+					writeError(recorder, req, 500, "Internal server error.")
+				}
+			}
+			span.SetHTTPStatus(recorder.status)
+			span.End()
+			logAccess := logger.Info
+			if isProbe(req) {
+				logAccess = logger.Debug
 			}
+			logAccess("Request",
+				"method", req.Method,
+				"path", req.URL.Path,
+				"query", redactQuery(req.URL.Query()),
+				"remote", req.RemoteAddr,
+				"status", recorder.status,
+				"duration_ms", time.Since(start).Seconds()*1000)
 		}()
-		fn(w, req)
+		fn(recorder, req)
 	}
 }
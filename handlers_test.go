@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContactEmailValidation(t *testing.T) {
+	fmt.Println("Running Test: TestContactEmailValidation")
+
+	// Setup
+	datastore = NewMockDatastore()
+	handler, key := buildTestHandler(), buildTestKey(ScopeAdmin)
+
+	res := doAuthRequest(handler, "POST", "/contacts/", `{"email":"not-an-email","name":"Bad"}`, key)
+	if res.Code != 400 {
+		t.Errorf("Invalid email returned %d should be 400.", res.Code)
+	}
+
+	res = doAuthRequest(handler, "POST", "/contacts/", `{"email":" Jane@Example.com ","name":"Jane"}`, key)
+	if res.Code != 200 {
+		t.Fatalf("Create contact returned %d should be 200.", res.Code)
+	}
+	var contact Contact
+	json.Unmarshal(res.Body.Bytes(), &contact)
+	if contact.Email != "jane@example.com" {
+		t.Errorf("Stored email %s should be normalized.", contact.Email)
+	}
+
+	res = doAuthRequest(handler, "POST", "/contacts/", `{"email":"JANE@example.com","name":"Jane Again"}`, key)
+	if res.Code != 409 {
+		t.Errorf("Duplicate email returned %d should be 409.", res.Code)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestContactMerge(t *testing.T) {
+	fmt.Println("Running Test: TestContactMerge")
+
+	// Setup
+	datastore = NewMockDatastore()
+	handler, key := buildTestHandler(), buildTestKey(ScopeAdmin)
+	target, _ := datastore.StoreContact(Contact{Email: "a@example.com", Tags: []string{"one", "two"}})
+	source, _ := datastore.StoreContact(Contact{Email: "b@example.com", Name: "B", Tags: []string{"two", "three"}})
+
+	res := doAuthRequest(handler, "POST", "/contacts/"+target.Id.Hex()+"/merge?source="+source.Id.Hex(), "", key)
+	if res.Code != 200 {
+		t.Fatalf("Merge returned %d should be 200.", res.Code)
+	}
+	var merged Contact
+	json.Unmarshal(res.Body.Bytes(), &merged)
+	if merged.Email != "a@example.com" || merged.Name != "B" || len(merged.Tags) != 3 {
+		t.Errorf("Unexpected merge result: %+v", merged)
+	}
+	if len(datastore.RetrieveContactsBy("id", source.Id.Hex())) != 0 {
+		t.Errorf("Merge source should have been removed.")
+	}
+
+	res = doAuthRequest(handler, "POST", "/contacts/"+target.Id.Hex()+"/merge?source="+source.Id.Hex(), "", key)
+	if res.Code != 404 {
+		t.Errorf("Merge with missing source returned %d should be 404.", res.Code)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestContactPatch(t *testing.T) {
+	fmt.Println("Running Test: TestContactPatch")
+
+	// Setup
+	datastore = NewMockDatastore()
+	handler, key := buildTestHandler(), buildTestKey(ScopeAdmin)
+	contact, _ := datastore.StoreContact(Contact{Email: "a@example.com", Name: "A", Tags: []string{"one"}})
+	url := "/contacts/" + contact.Id.Hex()
+
+	res := doAuthRequest(handler, "PATCH", url, `{"name":"Alice"}`, key)
+	if res.Code != 200 {
+		t.Fatalf("Patch returned %d should be 200.", res.Code)
+	}
+	var patched Contact
+	json.Unmarshal(res.Body.Bytes(), &patched)
+	if patched.Name != "Alice" || patched.Email != "a@example.com" || len(patched.Tags) != 1 {
+		t.Errorf("Unexpected patch result: %+v", patched)
+	}
+	if res.Header().Get("ETag") != `"2"` {
+		t.Errorf("Patch returned ETag %s should be \"2\".", res.Header().Get("ETag"))
+	}
+
+	// Stale If-Match
+	req := httptest.NewRequest("PATCH", url, strings.NewReader(`{"name":"Stale"}`))
+	req.Header.Set("If-Match", `"1"`)
+	req.Header.Set("Authorization", "Bearer "+key)
+	res = httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != 412 {
+		t.Errorf("Stale If-Match returned %d should be 412.", res.Code)
+	}
+
+	res = doAuthRequest(handler, "PATCH", "/contacts/"+bson.NewObjectId().Hex(), `{"name":"Nobody"}`, key)
+	if res.Code != 404 {
+		t.Errorf("Patch of unknown contact returned %d should be 404.", res.Code)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestContactTags(t *testing.T) {
+	fmt.Println("Running Test: TestContactTags")
+
+	// Setup
+	datastore = NewMockDatastore()
+	handler, key := buildTestHandler(), buildTestKey(ScopeAdmin)
+	contact, _ := datastore.StoreContact(Contact{Email: "a@example.com", Tags: []string{"one"}})
+	url := "/contacts/" + contact.Id.Hex() + "/tags/"
+
+	doAuthRequest(handler, "PUT", url+"two", "", key)
+	res := doAuthRequest(handler, "DELETE", url+"one", "", key)
+	if res.Code != 200 {
+		t.Fatalf("Remove tag returned %d should be 200.", res.Code)
+	}
+	var result Contact
+	json.Unmarshal(res.Body.Bytes(), &result)
+	if len(result.Tags) != 1 || result.Tags[0] != "two" {
+		t.Errorf("Tags are %v should be [two].", result.Tags)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestContactFields(t *testing.T) {
+	fmt.Println("Running Test: TestContactFields")
+
+	// Setup
+	datastore = NewMockDatastore()
+	handler, key := buildTestHandler(), buildTestKey(ScopeAdmin)
+
+	res := doAuthRequest(handler, "POST", "/contacts/", `{"email":"a@example.com","fields":{"plan":"pro","seats":5,"signup":"2015-10-01T00:00:00Z"}}`, key)
+	if res.Code != 200 {
+		t.Fatalf("Create contact returned %d should be 200.", res.Code)
+	}
+	res = doAuthRequest(handler, "POST", "/contacts/", `{"email":"b@example.com","fields":{"bad.name":"x"}}`, key)
+	if res.Code != 400 {
+		t.Errorf("Invalid field name returned %d should be 400.", res.Code)
+	}
+
+	var contacts []Contact
+	res = doAuthRequest(handler, "GET", "/contacts/?fields.seats=5", "", key)
+	json.Unmarshal(res.Body.Bytes(), &contacts)
+	if len(contacts) != 1 {
+		t.Errorf("Field query returned %d contacts should be 1.", len(contacts))
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+// Helper functions
+func doRequest(handler http.HandlerFunc, method string, url string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	res := httptest.NewRecorder()
+	handler(res, req)
+	return res
+}
+
+func doAuthRequest(handler http.HandlerFunc, method string, url string, body string, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+key)
+	res := httptest.NewRecorder()
+	handler(res, req)
+	return res
+}
+
+// Handler with all routes and middleware registered
+func buildTestHandler() http.HandlerFunc {
+	return routes()
+}
+
+func authRequest(key string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	return req
+}
+
+// Store a new API key with the given scopes and return the plaintext
+func buildTestKey(scopes ...string) string {
+	key, plaintext := newAPIKey("test", scopes)
+	datastore.StoreAPIKey(key)
+	return plaintext
+}
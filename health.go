@@ -0,0 +1,118 @@
+// Liveness and readiness checks for orchestrators
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var startTime = time.Now()
+
+// Unix nanoseconds of the last completed Mail Server check
+var lastServersCheck int64
+
+// How long a readiness check waits on the Datastore
+var readyTimeout = 2 * time.Second
+
+type healthCheck struct {
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Uptime string                 `json:"uptime"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// Health probes run every few seconds, keep them out of the access log
+func isProbe(req *http.Request) bool {
+	return req.URL.Path == "/healthz" || req.URL.Path == "/readyz"
+}
+
+func markServersChecked() {
+	atomic.StoreInt64(&lastServersCheck, time.Now().UnixNano())
+}
+
+// Run every readiness check, the instance is ready if all pass
+func checkReadiness() (healthReport, bool) {
+	checks := map[string]healthCheck{
+		"datastore": checkDatastore(),
+		"providers": checkProviders(),
+		"workers":   checkWorkers(),
+		"shutdown":  checkShutdown(),
+	}
+	report := healthReport{Status: "ready", Uptime: time.Since(startTime).Round(time.Second).String(), Checks: checks}
+	for _, check := range checks {
+		if !check.Ok {
+			report.Status = "not ready"
+			return report, false
+		}
+	}
+	return report, true
+}
+
+// Not ready once shutdown has started, so traffic drains elsewhere
+func checkShutdown() healthCheck {
+	if isShuttingDown() {
+		return healthCheck{Detail: "shutting down"}
+	}
+	return healthCheck{Ok: true}
+}
+
+// Ping the Datastore, giving up after readyTimeout
+func checkDatastore() healthCheck {
+	if datastore == nil {
+		return healthCheck{Detail: "not configured"}
+	}
+	result := make(chan bool, 1)
+	go func() {
+		result <- datastore.Ping()
+	}()
+	select {
+	case ok := <-result:
+		if !ok {
+			return healthCheck{Detail: "unreachable"}
+		}
+		return healthCheck{Ok: true}
+	case <-time.After(readyTimeout):
+		return healthCheck{Detail: "timed out"}
+	}
+}
+
+// At least one Mail Server up and within its quota
+func checkProviders() healthCheck {
+	up := 0
+	available := 0
+	servers := serverStatuses()
+	for server, status := range servers {
+		if status {
+			up++
+		}
+		if providerSelectable(server.GetName(), status) && providerAvailable(server.GetName(), 1) {
+			available++
+		}
+	}
+	detail := fmt.Sprintf("%d of %d up, %d available", up, len(servers), available)
+	return healthCheck{Ok: available > 0, Detail: detail}
+}
+
+// The background Mail Server pinger is still checking on schedule
+func checkWorkers() healthCheck {
+	if !pinging() {
+		return healthCheck{Detail: "pinger not started"}
+	}
+	last := atomic.LoadInt64(&lastServersCheck)
+	if last == 0 {
+		return healthCheck{Detail: "pinger has not run"}
+	}
+	// Allow a missed tick before reporting the pinger stalled
+	since := time.Since(time.Unix(0, last))
+	if since > 2*time.Duration(currentConfig().PingPeriod)*time.Second+readyTimeout {
+		return healthCheck{Detail: "pinger stalled for " + since.Round(time.Second).String()}
+	}
+	return healthCheck{Ok: true}
+}
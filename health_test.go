@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	fmt.Println("Running Test: TestHealthz")
+
+	// Setup
+	handler := buildTestHandler()
+
+	res := doRequest(handler, "GET", "/healthz", "")
+	if res.Code != 200 || !strings.Contains(res.Body.String(), `"status":"ok"`) {
+		t.Errorf("GET /healthz returned %d %s", res.Code, res.Body.String())
+	}
+	res = doRequest(handler, "POST", "/healthz", "")
+	if res.Code != 405 {
+		t.Errorf("POST /healthz returned %d should be 405.", res.Code)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestReadyz(t *testing.T) {
+	fmt.Println("Running Test: TestReadyz")
+
+	// Setup
+	datastore = NewMockDatastore()
+	config = Config{EmailThrottle: 5, PingPeriod: 60}
+	Servers = map[MailSender]bool{&MockServer{}: true}
+	initProviderLimits()
+	handler := buildTestHandler()
+	quit = make(chan struct{})
+	defer func() { quit = nil }()
+
+	// Ready once the pinger has checked the Mail Servers
+	checkServers()
+	res := doRequest(handler, "GET", "/readyz", "")
+	if res.Code != 200 || !strings.Contains(res.Body.String(), `"status":"ready"`) {
+		t.Errorf("GET /readyz returned %d %s", res.Code, res.Body.String())
+	}
+
+	Servers = map[MailSender]bool{&MockServer{}: false}
+	res = doRequest(handler, "GET", "/readyz", "")
+	if res.Code != 503 || !strings.Contains(res.Body.String(), `"providers":{"ok":false,"detail":"0 of 1 up, 0 available"}`) {
+		t.Errorf("GET /readyz with no provider up returned %d %s", res.Code, res.Body.String())
+	}
+
+	fmt.Println("Test Complete.")
+}
@@ -0,0 +1,261 @@
+// Log file output with size and age based rotation, reopened on SIGHUP
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log file rotation settings, zero disables each
+type LogRotation struct {
+	MaxSizeMB        int  // Rotate once the file reaches this size
+	MaxAgeHours      int  // Rotate once the file is this old
+	MaxBackups       int  // Rotated files to keep, oldest are removed
+	MaxBackupAgeDays int  // Rotated files older than this are removed
+	Compress         bool // Gzip rotated files
+}
+
+// Log file that rotates itself by size or age and can be reopened after
+// being moved by an external tool such as logrotate
+type rotatingFile struct {
+	mu       sync.Mutex
+	name     string
+	rotation LogRotation
+	file     *os.File
+	size     int64
+	opened   time.Time
+
+	// Rotated files being compressed, left alone by prune
+	compressing map[string]bool
+	background  sync.WaitGroup
+}
+
+var logFile *rotatingFile
+
+// Time format of rotated file suffixes, sorts oldest first
+const rotatedTimeFormat = "2006-01-02T15-04-05.000"
+
+// Suffix of a rotated file: its rotation time, a counter when several
+// rotated within a millisecond and .gz once compressed
+var rotatedSuffix = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}\.\d{3})(-\d+)?(\.gz)?$`)
+
+func openLogFile(name string, rotation LogRotation) (*rotatingFile, error) {
+	f := &rotatingFile{name: name, rotation: rotation, compressing: make(map[string]bool)}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	err := os.MkdirAll(filepath.Dir(f.name), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return os.Stdout.Write(p)
+	}
+	if f.due(int64(len(p))) {
+		f.rotate()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Whether writing n more bytes should go to a new file
+func (f *rotatingFile) due(n int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.rotation.MaxSizeMB > 0 && f.size+n > int64(f.rotation.MaxSizeMB)*1024*1024 {
+		return true
+	}
+	return f.rotation.MaxAgeHours > 0 && time.Since(f.opened) >= time.Duration(f.rotation.MaxAgeHours)*time.Hour
+}
+
+// Move the current file aside and start a new one, compressing and
+// pruning old files in the background so writers are not held up. On
+// failure logging carries on in the current file
+func (f *rotatingFile) rotate() {
+	rotated := f.name + "." + time.Now().UTC().Format(rotatedTimeFormat)
+	for i := 1; exists(rotated) || exists(rotated+".gz"); i++ {
+		rotated = f.name + "." + time.Now().UTC().Format(rotatedTimeFormat) + "-" + strconv.Itoa(i)
+	}
+	f.file.Close()
+	err := os.Rename(f.name, rotated)
+	if reopenErr := f.open(); reopenErr != nil {
+		f.file = nil
+		os.Stderr.WriteString("Error reopening log file: " + reopenErr.Error() + "\n")
+		return
+	}
+	if err != nil {
+		return
+	}
+	compress := f.rotation.Compress
+	if compress {
+		f.compressing[rotated] = true
+	}
+	f.background.Add(1)
+	go func() {
+		defer f.background.Done()
+		if compress {
+			compressFile(rotated)
+			f.mu.Lock()
+			delete(f.compressing, rotated)
+			f.mu.Unlock()
+		}
+		f.prune()
+	}()
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// Remove the oldest rotated files beyond MaxBackups or older than
+// MaxBackupAgeDays. Pruning stops at a file still being compressed, the
+// compression prunes again once done
+func (f *rotatingFile) prune() {
+	if f.rotation.MaxBackups <= 0 && f.rotation.MaxBackupAgeDays <= 0 {
+		return
+	}
+	backups := f.backups()
+	expired := time.Now().Add(-time.Duration(f.rotation.MaxBackupAgeDays) * 24 * time.Hour)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(backups) > 0 && !f.compressing[backups[0].name] {
+		tooMany := f.rotation.MaxBackups > 0 && len(backups) > f.rotation.MaxBackups
+		tooOld := f.rotation.MaxBackupAgeDays > 0 && backups[0].rotated.Before(expired)
+		if !tooMany && !tooOld {
+			break
+		}
+		os.Remove(backups[0].name)
+		os.Remove(backups[0].name + ".gz")
+		backups = backups[1:]
+	}
+}
+
+type rotatedFile struct {
+	name    string // Without any .gz suffix
+	rotated time.Time
+}
+
+// Rotated files, oldest first. Other files sharing the name are ignored
+func (f *rotatingFile) backups() []rotatedFile {
+	matches, _ := filepath.Glob(f.name + ".*")
+	seen := make(map[string]bool)
+	backups := []rotatedFile{}
+	for _, match := range matches {
+		parts := rotatedSuffix.FindStringSubmatch(strings.TrimPrefix(match, f.name+"."))
+		if parts == nil {
+			continue
+		}
+		rotated, err := time.Parse(rotatedTimeFormat, parts[1])
+		name := strings.TrimSuffix(match, ".gz")
+		if err != nil || seen[name] {
+			continue
+		}
+		seen[name] = true
+		backups = append(backups, rotatedFile{name, rotated})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].name < backups[j].name
+	})
+	return backups
+}
+
+// Close and reopen the file by name, picking up a file moved elsewhere
+func (f *rotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+// Close the file once rotated files have been compressed and pruned
+func (f *rotatingFile) Close() error {
+	f.background.Wait()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// Replace the file with a gzipped copy
+func compressFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zip := gzip.NewWriter(out)
+	_, err = io.Copy(zip, in)
+	if err == nil {
+		err = zip.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+// Reopen the log file, if logging to one, after logrotate moves it
+func reopenLogFile() {
+	if logFile == nil {
+		return
+	}
+	err := logFile.Reopen()
+	if err != nil {
+		os.Stderr.WriteString("Error reopening log file: " + err.Error() + "\n")
+		return
+	}
+	Log.Info("Log file reopened", "file", logFile.name)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLogFileRotation(t *testing.T) {
+	fmt.Println("Running Test: TestLogFileRotation")
+
+	// Setup
+	dir, err := ioutil.TempDir("", "maelstrom")
+	check(err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "logs", "maelstrom.log")
+	file, err := openLogFile(name, LogRotation{MaxSizeMB: 1, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatalf("Error opening log file: %s", err)
+	}
+	defer file.Close()
+
+	line := []byte(strings.Repeat("x", 1023) + "\n")
+	for i := 0; i < 4*1024; i++ {
+		file.Write(line)
+	}
+	for i := 0; i < 1024; i++ {
+		file.Write(line)
+	}
+	file.background.Wait()
+
+	backups, _ := filepath.Glob(name + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 rotated files, found %v", backups)
+	}
+	for _, backup := range backups {
+		if !strings.HasSuffix(backup, ".gz") {
+			t.Errorf("Rotated file %s not compressed", backup)
+		}
+	}
+	in, _ := os.Open(backups[0])
+	defer in.Close()
+	zip, err := gzip.NewReader(in)
+	if err != nil {
+		t.Fatalf("Rotated file not gzip: %s", err)
+	}
+	content, _ := ioutil.ReadAll(zip)
+	if len(content) != 1024*1024 {
+		t.Errorf("Rotated file holds %d bytes, should be 1MB", len(content))
+	}
+	info, _ := os.Stat(name)
+	if info.Size() != 1024*1024 {
+		t.Errorf("Current file holds %d bytes, should be 1MB", info.Size())
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestLogFilePruneSkipsCompressing(t *testing.T) {
+	fmt.Println("Running Test: TestLogFilePruneSkipsCompressing")
+
+	// Setup
+	dir, err := ioutil.TempDir("", "maelstrom")
+	check(err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "maelstrom.log")
+	file, err := openLogFile(name, LogRotation{MaxBackups: 1, Compress: true})
+	if err != nil {
+		t.Fatalf("Error opening log file: %s", err)
+	}
+	defer file.Close()
+	oldest := name + ".2020-01-01T00-00-00.000"
+	newest := name + ".2020-01-02T00-00-00.000.gz"
+	for _, backup := range []string{oldest, oldest + ".gz", newest} {
+		ioutil.WriteFile(backup, []byte("x"), 0644)
+	}
+
+	// The oldest is still being compressed, so is kept for now
+	file.compressing[oldest] = true
+	file.prune()
+	if !exists(oldest) || !exists(oldest+".gz") || !exists(newest) {
+		t.Errorf("Prune removed a file being compressed")
+	}
+	delete(file.compressing, oldest)
+	os.Remove(oldest)
+	file.prune()
+	if exists(oldest+".gz") || !exists(newest) {
+		t.Errorf("Prune kept the oldest backup over MaxBackups")
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestLogFilePruneRetention(t *testing.T) {
+	fmt.Println("Running Test: TestLogFilePruneRetention")
+
+	// Setup
+	dir, err := ioutil.TempDir("", "maelstrom")
+	check(err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "maelstrom.log")
+	file, err := openLogFile(name, LogRotation{MaxBackups: 5, MaxBackupAgeDays: 7})
+	if err != nil {
+		t.Fatalf("Error opening log file: %s", err)
+	}
+	defer file.Close()
+	stamp := func(age time.Duration) string {
+		return name + "." + time.Now().Add(-age).UTC().Format(rotatedTimeFormat)
+	}
+	expired := stamp(10 * 24 * time.Hour)
+	recent := []string{stamp(2*time.Hour) + ".gz", stamp(time.Hour) + "-1", stamp(time.Minute)}
+	unrelated := []string{name + ".bak", name + ".2020-01-01", name + ".2020-01-01T00-00-00.000.tmp"}
+	for _, f := range append(append([]string{expired + ".gz"}, recent...), unrelated...) {
+		ioutil.WriteFile(f, []byte("x"), 0644)
+	}
+
+	file.prune()
+	if exists(expired + ".gz") {
+		t.Errorf("Backup older than MaxBackupAgeDays kept")
+	}
+	for _, f := range append(recent, unrelated...) {
+		if !exists(f) {
+			t.Errorf("Prune removed %s", f)
+		}
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestLogFileReopen(t *testing.T) {
+	fmt.Println("Running Test: TestLogFileReopen")
+
+	// Setup
+	dir, err := ioutil.TempDir("", "maelstrom")
+	check(err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "maelstrom.log")
+	file, err := openLogFile(name, LogRotation{})
+	if err != nil {
+		t.Fatalf("Error opening log file: %s", err)
+	}
+	defer file.Close()
+
+	// Moved aside as logrotate would
+	file.Write([]byte("before\n"))
+	os.Rename(name, name+".1")
+	file.Write([]byte("moved\n"))
+	err = file.Reopen()
+	if err != nil {
+		t.Fatalf("Error reopening log file: %s", err)
+	}
+	file.Write([]byte("after\n"))
+
+	moved, _ := ioutil.ReadFile(name + ".1")
+	current, _ := ioutil.ReadFile(name)
+	if !bytes.Equal(moved, []byte("before\nmoved\n")) || !bytes.Equal(current, []byte("after\n")) {
+		t.Errorf("Unexpected contents, moved %q current %q", moved, current)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestHangupReopensLogFile(t *testing.T) {
+	fmt.Println("Running Test: TestHangupReopensLogFile")
+
+	// Setup, logging to a file without a config file
+	dir, err := ioutil.TempDir("", "maelstrom")
+	check(err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "maelstrom.log")
+	file, err := openLogFile(name, LogRotation{})
+	if err != nil {
+		t.Fatalf("Error opening log file: %s", err)
+	}
+	logFile = file
+	initLogging(file, "json", LevelInfo, false)
+	defer initLogging(os.Stdout, "json", LevelDebug, false)
+	handleHangup("")
+
+	os.Rename(name, name+".1")
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	reopened := false
+	for i := 0; i < 100 && !reopened; i++ {
+		time.Sleep(10 * time.Millisecond)
+		current, _ := ioutil.ReadFile(name)
+		reopened = bytes.Contains(current, []byte("Log file reopened"))
+	}
+	if !reopened {
+		t.Errorf("Log file not reopened on SIGHUP")
+	}
+	initLogging(os.Stdout, "json", LevelDebug, false)
+	file.Close()
+	logFile = nil
+
+	fmt.Println("Test Complete.")
+}
@@ -0,0 +1,360 @@
+// Leveled structured logging as JSON or logfmt with secret redaction
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log levels, lowest first
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+var ErrInvalidLogLevel = errors.New("Invalid log level")
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "unknown"
+	}
+	return logLevelNames[l]
+}
+
+func parseLogLevel(name string) (LogLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, ErrInvalidLogLevel
+}
+
+// Structured logger writing one JSON or logfmt line per entry. Fields are
+// key/value pairs, values of sensitive keys are never written
+type Logger struct {
+	fields []interface{}
+}
+
+var Log = &Logger{}
+
+var logMutex sync.Mutex
+var logOutput io.Writer = os.Stdout
+var logFormat = "json"
+var logLevel = int32(LevelInfo)
+var logMessageBodies bool
+
+const redacted = "[REDACTED]"
+
+// Field names whose values are always redacted, matched anywhere in the
+// name or, for the short ones, exactly
+var sensitiveKeys = []string{"password", "secret", "apikey", "api_key", "authorization", "cookie", "token"}
+var sensitiveExactKeys = []string{"key", "sig", "code", "csrf"}
+
+// Message fields, redacted unless logMessageBodies is set
+var messageBodyKeys = []string{"text", "html"}
+
+// Credentials that may turn up inside free text
+var secretPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(apiKeyPrefix + `[A-Za-z0-9]+_[A-Za-z0-9]+`), redacted},
+	{regexp.MustCompile(`(?i)\b(bearer|basic)\s+\S+`), "${1} " + redacted},
+	{regexp.MustCompile(`(?i)\b((password|secret|token|apikey|api_key|sig)=)[^&\s"]+`), "${1}" + redacted},
+}
+
+// Set up the log destination, format and level
+func initLogging(writer io.Writer, format string, level LogLevel, messageBodies bool) {
+	logMutex.Lock()
+	logOutput = writer
+	if format == "logfmt" {
+		logFormat = "logfmt"
+	} else {
+		logFormat = "json"
+	}
+	logMessageBodies = messageBodies
+	logMutex.Unlock()
+	setLogLevel(level)
+}
+
+func setLogLevel(level LogLevel) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+func currentLogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&logLevel))
+}
+
+// Logger adding the given key/value pairs to every entry
+func (l *Logger) With(fields ...interface{}) *Logger {
+	combined := make([]interface{}, 0, len(l.fields)+len(fields))
+	combined = append(combined, l.fields...)
+	combined = append(combined, fields...)
+	return &Logger{fields: combined}
+}
+
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level >= currentLogLevel()
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.log(LevelDebug, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.log(LevelInfo, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	l.log(LevelWarn, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.log(LevelError, msg, fields)
+}
+
+func (l *Logger) log(level LogLevel, msg string, fields []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	all := append(append([]interface{}{}, l.fields...), fields...)
+	if len(all)%2 != 0 {
+		all = append(all, "")
+	}
+	entry := []interface{}{
+		"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"msg", redactText(msg),
+	}
+	for i := 0; i < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		entry = append(entry, key, redactValue(key, all[i+1]))
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	var line []byte
+	if logFormat == "logfmt" {
+		line = formatLogfmt(entry)
+	} else {
+		line = formatJSON(entry)
+	}
+	logOutput.Write(line)
+}
+
+func formatJSON(entry []interface{}) []byte {
+	var buff bytes.Buffer
+	buff.WriteByte('{')
+	for i := 0; i < len(entry); i += 2 {
+		if i > 0 {
+			buff.WriteByte(',')
+		}
+		key, _ := json.Marshal(entry[i])
+		buff.Write(key)
+		buff.WriteByte(':')
+		value, err := json.Marshal(entry[i+1])
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(entry[i+1]))
+		}
+		buff.Write(value)
+	}
+	buff.WriteString("}\n")
+	return buff.Bytes()
+}
+
+func formatLogfmt(entry []interface{}) []byte {
+	var buff bytes.Buffer
+	for i := 0; i < len(entry); i += 2 {
+		if i > 0 {
+			buff.WriteByte(' ')
+		}
+		buff.WriteString(fmt.Sprint(entry[i]))
+		buff.WriteByte('=')
+		value := fmt.Sprint(entry[i+1])
+		if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+			value = strconv.Quote(value)
+		}
+		buff.WriteString(value)
+	}
+	buff.WriteByte('\n')
+	return buff.Bytes()
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	for _, s := range sensitiveExactKeys {
+		if key == s {
+			return true
+		}
+	}
+	return false
+}
+
+func isMessageBodyKey(key string) bool {
+	for _, k := range messageBodyKeys {
+		if strings.EqualFold(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// Value as written to the log, errors as their message and strings
+// scrubbed of anything that looks like a credential
+func redactValue(key string, value interface{}) interface{} {
+	if isSensitiveKey(key) {
+		return redacted
+	}
+	switch v := value.(type) {
+	case error:
+		return redactText(v.Error())
+	case string:
+		return redactText(v)
+	case fmt.Stringer:
+		return redactText(v.String())
+	case []string:
+		scrubbed := make([]string, len(v))
+		for i, s := range v {
+			scrubbed[i] = redactText(s)
+		}
+		return scrubbed
+	}
+	return value
+}
+
+func redactText(text string) string {
+	for _, secret := range secretPatterns {
+		text = secret.pattern.ReplaceAllString(text, secret.replacement)
+	}
+	return text
+}
+
+// Query string with sensitive parameters redacted
+func redactQuery(values url.Values) string {
+	scrubbed := url.Values{}
+	for key, vals := range values {
+		for _, v := range vals {
+			if isSensitiveKey(key) {
+				v = redacted
+			}
+			scrubbed.Add(key, v)
+		}
+	}
+	return scrubbed.Encode()
+}
+
+// JSON body with sensitive fields, and message text and html unless
+// enabled, redacted. Anything else is only logged by size
+func redactBody(body []byte) interface{} {
+	var parsed interface{}
+	if len(body) == 0 || json.Unmarshal(body, &parsed) != nil {
+		return fmt.Sprintf("[%d bytes]", len(body))
+	}
+	logMutex.Lock()
+	bodies := logMessageBodies
+	logMutex.Unlock()
+	return redactJSON(parsed, bodies)
+}
+
+func redactJSON(value interface{}, bodies bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if isSensitiveKey(key) || (!bodies && isMessageBodyKey(key)) {
+				v[key] = redacted
+			} else {
+				v[key] = redactJSON(field, bodies)
+			}
+		}
+	case []interface{}:
+		for i, field := range v {
+			v[i] = redactJSON(field, bodies)
+		}
+	case string:
+		return redactText(v)
+	}
+	return value
+}
+
+type requestIdKey struct{}
+
+var requestIdRegex = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Reuse a well formed X-Request-Id from the caller or generate one
+func newRequestId(req *http.Request) string {
+	if id := req.Header.Get("X-Request-Id"); requestIdRegex.MatchString(id) {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withRequestId(req *http.Request, id string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestIdKey{}, id))
+}
+
+func requestId(req *http.Request) string {
+	id, _ := req.Context().Value(requestIdKey{}).(string)
+	return id
+}
+
+// Logger tagging every entry with the ID and trace of the request being
+// handled in ctx, if any
+func logFrom(ctx context.Context) *Logger {
+	logger := Log
+	if id, ok := ctx.Value(requestIdKey{}).(string); ok {
+		logger = logger.With("request_id", id)
+	}
+	if span := spanFrom(ctx); span != nil {
+		logger = logger.With("trace_id", span.Context().TraceID().String())
+	}
+	return logger
+}
+
+// Logger tagging every entry with the request's ID and trace
+func requestLog(req *http.Request) *Logger {
+	return logFrom(req.Context())
+}
+
+// Log the request body at debug level, leaving it readable for the handler
+func logRequestBody(req *http.Request) {
+	if !Log.Enabled(LevelDebug) || req.Body == nil {
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil || len(body) == 0 {
+		return
+	}
+	requestLog(req).Debug("Request body", "body", redactBody(body))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogFormats(t *testing.T) {
+	fmt.Println("Running Test: TestLogFormats")
+
+	// Setup
+	var buff bytes.Buffer
+	initLogging(&buff, "json", LevelInfo, false)
+	defer initLogging(os.Stdout, "json", LevelDebug, false)
+
+	Log.Debug("hidden")
+	Log.With("request_id", "abc").Info("shown", "count", 2, "error", fmt.Errorf("failed"))
+	var entry map[string]interface{}
+	err := json.Unmarshal(buff.Bytes(), &entry)
+	if err != nil {
+		t.Fatalf("Log line is not JSON: %s", buff.String())
+	}
+	if entry["msg"] != "shown" || entry["level"] != "info" || entry["request_id"] != "abc" || entry["count"] != 2.0 || entry["error"] != "failed" {
+		t.Errorf("Unexpected log entry %v", entry)
+	}
+
+	buff.Reset()
+	initLogging(&buff, "logfmt", LevelWarn, false)
+	Log.Info("hidden")
+	Log.Warn("shown here", "provider", "MailGun")
+	if !strings.Contains(buff.String(), `level=warn msg="shown here" provider=MailGun`) {
+		t.Errorf("Unexpected logfmt line %s", buff.String())
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestLogRedaction(t *testing.T) {
+	fmt.Println("Running Test: TestLogRedaction")
+
+	// Setup
+	var buff bytes.Buffer
+	initLogging(&buff, "json", LevelDebug, false)
+	defer initLogging(os.Stdout, "json", LevelDebug, false)
+
+	key := "mk_5f1c0c7e2a9b4b0001a1b2c3_0123456789abcdef"
+	Log.Info("Auth header Bearer "+key, "password", "hunter2", "apiKey", "abc", "url", "/login?password=hunter2&user=bob")
+	for _, secret := range []string{key, "hunter2", `"abc"`} {
+		if strings.Contains(buff.String(), secret) {
+			t.Errorf("Secret %s logged: %s", secret, buff.String())
+		}
+	}
+	if !strings.Contains(buff.String(), "user=bob") {
+		t.Errorf("Non secret value redacted: %s", buff.String())
+	}
+
+	body := redactBody([]byte(`{"to":["a@example.com"],"subject":"Hi","text":"private","password":"x"}`)).(map[string]interface{})
+	if body["text"] != redacted || body["password"] != redacted || body["subject"] != "Hi" {
+		t.Errorf("Unexpected redacted body %v", body)
+	}
+	initLogging(&buff, "json", LevelDebug, true)
+	body = redactBody([]byte(`{"text":"private","password":"x"}`)).(map[string]interface{})
+	if body["text"] != "private" || body["password"] != redacted {
+		t.Errorf("Unexpected redacted body %v", body)
+	}
+	if redactBody([]byte("username=bob&password=x")) != "[23 bytes]" {
+		t.Errorf("Non JSON body should only be logged by size")
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestRequestId(t *testing.T) {
+	fmt.Println("Running Test: TestRequestId")
+
+	// Setup
+	var buff bytes.Buffer
+	initLogging(&buff, "json", LevelInfo, false)
+	defer initLogging(os.Stdout, "json", LevelDebug, false)
+	datastore = NewMockDatastore()
+	handler := buildTestHandler()
+	key := buildTestKey(ScopeAdmin)
+
+	res := doAuthRequest(handler, "GET", "/status", "", key)
+	id := res.Header().Get("X-Request-Id")
+	if len(id) == 0 {
+		t.Fatalf("Missing X-Request-Id header")
+	}
+	if !strings.Contains(buff.String(), `"request_id":"`+id+`"`) {
+		t.Errorf("Request ID %s not logged: %s", id, buff.String())
+	}
+	if strings.Contains(buff.String(), key) {
+		t.Errorf("API key logged: %s", buff.String())
+	}
+
+	req := httptest.NewRequest("GET", "/status", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set("X-Request-Id", "upstream-1")
+	res = httptest.NewRecorder()
+	handler(res, req)
+	if res.Header().Get("X-Request-Id") != "upstream-1" {
+		t.Errorf("Caller request ID not reused, got %s", res.Header().Get("X-Request-Id"))
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestLogFromContext(t *testing.T) {
+	fmt.Println("Running Test: TestLogFromContext")
+
+	// Setup
+	var buff bytes.Buffer
+	initLogging(&buff, "json", LevelDebug, false)
+	defer initLogging(os.Stdout, "json", LevelDebug, false)
+	req := withRequestId(httptest.NewRequest("POST", "/messages/", nil), "req-1")
+
+	// Datastore errors logged while handling a request carry its ID
+	db := NewMongoDatastore()
+	db.Close()
+	db.WithContext(req.Context()).RetrieveSuppressions()
+	if !strings.Contains(buff.String(), `"msg":"Error retrieving Suppressions","request_id":"req-1"`) {
+		t.Errorf("Datastore error not logged with request ID: %s", buff.String())
+	}
+
+	buff.Reset()
+	Servers = map[MailSender]bool{&MockServer{}: true}
+	config = Config{}
+	initProviderLimits()
+	chooseMailSender(req.Context(), 1)
+	if !strings.Contains(buff.String(), `"msg":"Selected Mail Server","request_id":"req-1"`) {
+		t.Errorf("Provider selection not logged with request ID: %s", buff.String())
+	}
+
+	buff.Reset()
+	logFrom(context.Background()).Info("background")
+	if strings.Contains(buff.String(), "request_id") {
+		t.Errorf("Background work logged with a request ID: %s", buff.String())
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	fmt.Println("Running Test: TestLogLevelHandler")
+
+	// Setup
+	datastore = NewMockDatastore()
+	handler := buildTestHandler()
+	admin := buildTestKey(ScopeAdmin)
+	sender := buildTestKey(ScopeSend)
+	defer setLogLevel(LevelDebug)
+
+	res := doAuthRequest(handler, "PUT", "/loglevel", `{"level":"warn"}`, sender)
+	if res.Code != 403 {
+		t.Errorf("Non admin PUT /loglevel returned %d should be 403.", res.Code)
+	}
+	res = doAuthRequest(handler, "PUT", "/loglevel", `{"level":"loud"}`, admin)
+	if res.Code != 400 {
+		t.Errorf("Invalid level returned %d should be 400.", res.Code)
+	}
+	res = doAuthRequest(handler, "PUT", "/loglevel", `{"level":"warn"}`, admin)
+	if res.Code != 200 || currentLogLevel() != LevelWarn {
+		t.Errorf("PUT /loglevel returned %d, level %s", res.Code, currentLogLevel())
+	}
+	res = doAuthRequest(handler, "GET", "/loglevel", "", admin)
+	if !strings.Contains(res.Body.String(), `"level":"warn"`) {
+		t.Errorf("Unexpected GET /loglevel body %s", res.Body.String())
+	}
+
+	fmt.Println("Test Complete.")
+}
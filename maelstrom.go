@@ -1,202 +1,321 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"golang.org/x/crypto/acme/autocert"
 	"google.golang.org/cloud/compute/metadata"
 	"gopkg.in/mgo.v2/bson"
 	"io"
-	"log"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 )
 
 var config Config
-var Debug bool
 var gce bool
 var Password string
 var quit chan struct{}
+var quitLock sync.Mutex
 var Servers map[MailSender]bool
 var emailRegex string = "\\b[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\\.[a-zA-Z]{2,4}\\b"
 var indexHtml = "resources/html/index.html"
-var throttle chan int
+var unsubscribeHtml = "resources/html/unsubscribe.html"
+var loginHtml = "resources/html/login.html"
 var datastore Datastore
-var InfoLog *log.Logger
-var ErrorLog *log.Logger
 
 func init() {
 
-	// Read Config file
-	config = Config{}
-	file, err := os.Open("conf.json")
-	if err != nil {
-		fmt.Println("No config file found. Using Defaults")
-		config.PingPeriod = 60
-		config.EmailThrottle = 5
-	} else {
-		decoder := json.NewDecoder(file)
-		err = decoder.Decode(&config)
-		check(err)
+	// Check if running on GCE
+	gce = metadata.OnGCE()
+}
+
+func main() {
+
+	// Parse command line args. Config settings given as flags override the
+	// config file and environment variables
+	flagSettings := []configSetting{}
+	configFlag := func(name string, path string, usage string) {
+		flag.Func(name, usage, func(value string) error {
+			flagSettings = append(flagSettings, configSetting{"-" + name, []string{path}, value})
+			return nil
+		})
 	}
+	path := flag.String("config", os.Getenv("MAELSTROM_CONFIG"), "Config file, JSON, YAML or TOML by extension. Defaults to conf.json if present.")
+	configFlag("port", "port", "Port to listen on, default 8123.")
+	configFlag("pingperiod", "pingPeriod", "Seconds between Mail Server pings, default 60.")
+	configFlag("emailthrottle", "emailThrottle", "Sends allowed per second, default 5.")
+	configFlag("loglevel", "logLevel", "Log level: debug, info, warn or error.")
+	configFlag("logformat", "logFormat", "Log format: json or logfmt.")
+	configFlag("logfile", "logFileName", "Log to this file instead of stdout.")
+	flag.Func("set", "Set any config value by path, e.g. -set mailServers.0.apiKey=key. May be repeated.", func(value string) error {
+		setting, err := parseSetting(value)
+		flagSettings = append(flagSettings, setting)
+		return err
+	})
+	debug := flag.Bool("debug", false, "Turn on debug logging, same as -loglevel debug.")
+	flag.StringVar(&Password, "password", "", "Bootstrap admin API key, used to create per client API keys.")
+	flag.Parse()
 
-	// Check if running on GCE
-	if metadata.OnGCE() {
-		if Debug {
-			fmt.Println("Running on GCE. Pulling attributes.")
-		}
-		gce = true
-	} else {
-		if Debug {
-			fmt.Println("Not running on GCE.")
+	if *debug {
+		flagSettings = append(flagSettings, configSetting{"-debug", []string{"logLevel"}, "debug"})
+	}
+	configOverrides = append(envSettings(os.Environ()), flagSettings...)
+
+	// Read Config file, conf.json is optional unless named
+	if len(*path) > 0 {
+		configFile = *path
+	} else if _, err := os.Stat(configFile); os.IsNotExist(err) {
+		fmt.Println("No config file found. Using Defaults")
+		configFile = ""
+	}
+	conf, err := loadConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:")
+		if errs, ok := err.(configErrors); ok {
+			for _, e := range errs {
+				fmt.Fprintln(os.Stderr, "  "+e)
+			}
+		} else {
+			fmt.Fprintln(os.Stderr, "  "+err.Error())
 		}
-		gce = false
+		os.Exit(1)
 	}
+	setConfig(conf)
+
 	// init loggers
-	var writer io.Writer
-	if len(config.LogFileName) > 0 {
-		// Create Directory
-		// os.MkdirAll(, 0777)
-		logFile, err := os.OpenFile(config.LogFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	var writer io.Writer = os.Stdout
+	if len(conf.LogFileName) > 0 {
+		file, err := openLogFile(conf.LogFileName, conf.LogRotation)
 		if err != nil {
 			fmt.Println("Error opening log file: ", err)
-			writer = os.Stdout
 		} else {
-			defer logFile.Close()
-			writer = logFile
+			logFile = file
+			writer = file
 		}
-	} else {
-		writer = os.Stdout
 	}
+	level, _ := parseLogLevel(conf.LogLevel)
+	initLogging(writer, conf.LogFormat, level, conf.LogMessageBodies)
+	Log.Debug("Checked for GCE", "gce", gce)
 
-	InfoLog = log.New(writer, "INFO: ", log.LstdFlags)
-	ErrorLog = log.New(writer, "ERROR: ", log.LstdFlags)
-}
-
-func main() {
+	handleHangup(configFile)
+	if len(configFile) > 0 {
+		watchConfig(configFile)
+	}
 
-	// Parse command line args
-	flag.BoolVar(&Debug, "debug", true, "Turn on debug logging.")
-	flag.StringVar(&Password, "password", "", "Password needed by users to send emails.")
-	flag.Parse()
+	initTracing(currentConfig().Tracing)
 
-	// Check GCE for Password
-	if gce {
-		pw, _ := metadata.InstanceAttributeValue("emailPW")
-		if len(pw) > 0 {
-			Password = pw
-		}
+	// The bootstrap admin key may be a secret reference, on GCE it
+	// defaults to the emailPW attribute
+	if gce && len(Password) == 0 {
+		Password = "gce:emailPW"
+	}
+	providers, _ := secretProvidersFor(conf.Vault)
+	Password, err = resolveSecret(Password, providers)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid -password: "+err.Error())
+		os.Exit(1)
 	}
 
-	// Initiate throttle
-	throttle = make(chan int, config.EmailThrottle)
-
-	buildServersMap()
+	initUnsubscribeKey(currentConfig().UnsubscribeSecret)
 
-	initiatePing()
+	// Initiate rate limits
+	initRateLimits()
 
 	// Create Database
-	datastore = &MongoDatastore{}
+	if len(conf.MongoUrl) > 0 {
+		mongoUrl = conf.MongoUrl
+	}
+	datastore = NewMongoDatastore()
 	if datastore.Ping() {
-		InfoLog.Println("MongoDB running.")
+		Log.Info("MongoDB running.")
 	} else {
-		ErrorLog.Println("MongoDB connection unsuccessful.")
+		Log.Error("MongoDB connection unsuccessful.")
 	}
 
-	http.HandleFunc("/", errorHandler(rootHandler))
-	http.HandleFunc("/messages/", errorHandler(messageHandler))
-	http.HandleFunc("/status", errorHandler(statusHandler))
-	http.HandleFunc("/contacts/", errorHandler(contactsHandler))
+	loadProviderOverrides()
 
-	// To Serve CSS and JS files
-	http.Handle("/resources/", http.StripPrefix("/resources/", http.FileServer(http.Dir("resources"))))
+	buildServersMap()
 
-	// Read Port from Env
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8123"
+	initiatePing()
+
+	port := currentConfig().Port
+
+	server := &http.Server{Addr: ":" + port, Handler: hstsHandler(routes())}
+	done := handleShutdown(server)
+
+	tlsConf := currentConfig().TLS
+	if tlsEnabled(tlsConf) {
+		var manager *autocert.Manager
+		server.TLSConfig, manager, err = buildTLSConfig(tlsConf)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid TLS configuration: "+err.Error())
+			os.Exit(1)
+		}
+		if len(tlsConf.RedirectPort) > 0 {
+			startRedirectServer(server, tlsConf.RedirectPort, port, manager)
+		}
+		Log.Info("Server running", "port", port, "tls", true)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		Log.Info("Server running", "port", port)
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		Log.Error("Server stopped", "error", err)
+		os.Exit(1)
 	}
+	<-done
+}
 
-	if Debug {
-		InfoLog.Println("Server running on Port:", port)
+// Handler for all routes. Everything except the UI and login pages, static
+// resources and signed unsubscribe links requires an API key or session
+func routes() http.HandlerFunc {
+	router := NewRouter()
+	router.NotFound = func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, req, 404, "No such resource "+req.URL.Path+".")
+	}
+	router.MethodNotAllowed = func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, req, 405, req.Method+" is not allowed, use "+w.Header().Get("Allow")+".")
 	}
+	router.Handle("GET", "/", rootHandler)
+	router.Handle("GET", "/healthz", healthzHandler)
+	router.Handle("GET", "/readyz", readyzHandler)
+	router.Handle("GET", "/unsubscribe", unsubscribeHandler)
+	router.Handle("POST", "/unsubscribe", unsubscribeHandler)
+	router.Handle("GET", "/login", loginHandler)
+	router.Handle("POST", "/login", loginHandler)
+	router.Handle("GET", "/login/oidc", oidcLoginHandler)
+	router.Handle("GET", "/login/oidc/callback", oidcCallbackHandler)
+	router.Handle("POST", "/logout", authHandler(ScopeAny, logoutHandler))
+
+	// The API is served under /v1 and, for existing clients, at its
+	// original unversioned paths
+	for _, version := range []string{"/v1", ""} {
+		api := func(method string, pattern string, scope string, fn http.HandlerFunc) {
+			router.Handle(method, version+pattern, authHandler(scope, fn))
+		}
+		api("POST", "/messages/", ScopeSend, messageHandler)
+		api("GET", "/status", ScopeAny, statusHandler)
+		api("GET", "/history", ScopeAny, historyHandler)
+		api("GET", "/metrics", ScopeAny, metricsHandler)
+		api("GET", "/loglevel", ScopeAdmin, logLevelHandler)
+		api("PUT", "/loglevel", ScopeAdmin, logLevelHandler)
+
+		api("GET", "/contacts/", ScopeContactsRead, contactRoute("get", getContactsHandler))
+		api("POST", "/contacts/", ScopeContactsWrite, contactRoute("create", createContactHandler))
+		api("GET", "/contacts/{id}", ScopeContactsRead, contactRoute("get", getContactsHandler))
+		api("PUT", "/contacts/{id}", ScopeContactsWrite, contactRoute("update", updateContactHandler))
+		api("PATCH", "/contacts/{id}", ScopeContactsWrite, contactRoute("patch", patchContactHandler))
+		api("DELETE", "/contacts/{id}", ScopeContactsWrite, contactRoute("delete", deleteContactHandler))
+		api("POST", "/contacts/{id}/merge", ScopeContactsWrite, contactRoute("merge", mergeContactHandler))
+		api("PUT", "/contacts/{id}/tags/{tag}", ScopeContactsWrite, contactRoute("add_tag", addContactTagHandler))
+		api("DELETE", "/contacts/{id}/tags/{tag}", ScopeContactsWrite, contactRoute("remove_tag", removeContactTagHandler))
+
+		api("GET", "/suppressions/", ScopeContactsRead, getSuppressionsHandler)
+		api("POST", "/suppressions/", ScopeContactsWrite, createSuppressionHandler)
+		api("GET", "/suppressions/{email}", ScopeContactsRead, getSuppressionsHandler)
+		api("DELETE", "/suppressions/{email}", ScopeContactsWrite, deleteSuppressionHandler)
+
+		api("GET", "/apikeys/", ScopeAdmin, getAPIKeysHandler)
+		api("POST", "/apikeys/", ScopeAdmin, createAPIKeyHandler)
+		api("DELETE", "/apikeys/{id}", ScopeAdmin, revokeAPIKeyHandler)
+
+		api("GET", "/users/", ScopeAdmin, getUsersHandler)
+		api("POST", "/users/", ScopeAdmin, createUserHandler)
+		api("DELETE", "/users/{id}", ScopeAdmin, deleteUserHandler)
+
+		api("GET", "/providers/", ScopeAdmin, getProvidersHandler)
+		api("PUT", "/providers/{name}", ScopeAdmin, updateProviderHandler)
+		api("POST", "/providers/{name}/{action}", ScopeAdmin, providerActionHandler)
+	}
+
+	// Unversioned clients could also address a contact with ?id=
+	router.Handle("PUT", "/contacts/", authHandler(ScopeContactsWrite, contactRoute("update", updateContactHandler)))
+	router.Handle("PATCH", "/contacts/", authHandler(ScopeContactsWrite, contactRoute("patch", patchContactHandler)))
+	router.Handle("DELETE", "/contacts/", authHandler(ScopeContactsWrite, contactRoute("delete", deleteContactHandler)))
 
-	http.ListenAndServe(":"+port, nil)
+	// To Serve CSS and JS files
+	router.HandlePrefix("/resources/", http.StripPrefix("/resources/", fileHandler("resources")))
+
+	return errorHandler(router.ServeHTTP)
 }
 
 // Generic Interface for a Mail Server
 type MailSender interface {
-	Send(Message) int
+	Send(context.Context, Message) int
 	Ping() bool
 	GetName() string
 	SetKey(string)
 }
 
-// Select a MailServer which is currently 'up'
+// Select a MailServer which is currently 'up' with quota left for count sends
 // TODO allow specifying of Server?
-func chooseMailSender() MailSender {
+func chooseMailSender(ctx context.Context, count int) MailSender {
 
 	// Weighted Ranking? Random?
-	for serv, status := range Servers {
-		if status {
-			if Debug {
-				InfoLog.Printf("Selected Mail Server: %s\n", serv.GetName())
-			}
+	for serv, status := range serverStatuses() {
+		if providerSelectable(serv.GetName(), status) && providerAvailable(serv.GetName(), count) {
+			logFrom(ctx).Debug("Selected Mail Server", "provider", serv.GetName())
 			return serv
 		}
 	}
 
-	if Debug {
-		ErrorLog.Println("No MailServers are currently available")
-	}
+	logFrom(ctx).Warn("No MailServers are currently available")
 	return nil
 }
 
 // Build list of Servers as defined in the Configuration
 func buildServersMap() {
-	Servers = make(map[MailSender]bool)
-	for _, conf := range config.MailServers {
-		if Debug {
-			InfoLog.Println("Adding Server: " + conf.Name)
-		}
-		var server MailSender
-		if conf.Name == "MailGun" {
-			server = &MailGunServer{conf}
-		} else if conf.Name == "SendGrid" {
-			server = &SendGridServer{conf}
-		} else if conf.Name == "Mandrill" {
-			server = &MandrillServer{conf}
-		} else if conf.Name == "AWS" {
-			server = &AwsServer{conf}
-		} else {
-			if Debug {
-				ErrorLog.Println("Unknown MailServer: " + conf.Name)
-			}
+	servers := make(map[MailSender]bool)
+	for _, conf := range mailServerConfigs() {
+		Log.Debug("Adding Server", "provider", conf.Name)
+		server := newMailSender(conf)
+		if server == nil {
+			Log.Warn("Unknown MailServer", "provider", conf.Name)
 			continue
 		}
-		var apiKey string
-		if gce {
-			apiKey, _ = metadata.InstanceAttributeValue(conf.Name)
-		} else {
-			apiKey = conf.ApiKey
-		}
-		server.SetKey(apiKey)
-		Servers[server] = false
+		server.SetKey(conf.ApiKey)
+		servers[server] = false
 	}
+	serversLock.Lock()
+	Servers = servers
+	serversLock.Unlock()
+	initProviderLimits()
 	checkServers()
 }
 
+// Mail Server for a configured provider, nil if the name is unknown
+func newMailSender(conf MailServer) MailSender {
+	switch conf.Name {
+	case "MailGun":
+		return &MailGunServer{conf}
+	case "SendGrid":
+		return &SendGridServer{conf}
+	case "Mandrill":
+		return &MandrillServer{conf}
+	case "AWS":
+		return &AwsServer{conf}
+	}
+	return nil
+}
+
 // Starts a periodic Ping for the Mail Servers
 func initiatePing() {
-	pinger := time.NewTicker(time.Duration(config.PingPeriod) * time.Second)
+	pinger := time.NewTicker(time.Duration(currentConfig().PingPeriod) * time.Second)
+	quitLock.Lock()
 	quit = make(chan struct{})
+	stop := quit
+	quitLock.Unlock()
 	go func() {
 		for {
 			select {
 			case <-pinger.C:
 				checkServers()
-			case <-quit:
+			case <-stop:
 				pinger.Stop()
 				return
 			}
@@ -204,66 +323,190 @@ func initiatePing() {
 	}()
 }
 
-// Check and update the status for all Mail Servers
-func checkServers() {
-	for server, _ := range Servers {
-		status := server.Ping()
-		if Debug {
-			InfoLog.Printf("Mail Server: %s status: %t\n", server.GetName(), status)
-		}
-		Servers[server] = status
+// Stops the periodic Ping
+func stopPing() {
+	quitLock.Lock()
+	defer quitLock.Unlock()
+	if quit != nil {
+		close(quit)
+		quit = nil
 	}
 }
 
-// Enforce Throttling by requiring a 'slot' to send
-func requestSlot() bool {
+// Whether the periodic Ping is running
+func pinging() bool {
+	quitLock.Lock()
+	defer quitLock.Unlock()
+	return quit != nil
+}
 
-	if len(throttle) >= cap(throttle) {
-		if Debug {
-			InfoLog.Println("Request blocked. No open slots.")
+// Check and update the status for all Mail Servers
+func checkServers() {
+	defer markServersChecked()
+
+	// Update the map being checked, Servers may be rebuilt meanwhile
+	serversLock.RLock()
+	servers := Servers
+	serversLock.RUnlock()
+	for server := range serverStatusesOf(servers) {
+		start := time.Now()
+		status := server.Ping()
+		recordPing(server.GetName(), status, time.Since(start))
+		Log.Debug("Mail Server status", "provider", server.GetName(), "up", status)
+		setServerStatus(servers, server, status)
+		if status {
+			providerUp.Set(1, server.GetName())
+		} else {
+			providerUp.Set(0, server.GetName())
 		}
-		return false
 	}
-	throttle <- 1
-	slotTimer := time.NewTimer(time.Second * 1)
-	go func() {
-		<-slotTimer.C
-		_ = <-throttle
-	}()
-	return true
 }
 
 // Standard error check function
 func check(err error) {
 	if err != nil {
-		ErrorLog.Println("Panicking: ", err)
+		Log.Error("Panicking", "error", err)
 		panic(err)
 	}
 }
 
+// Errors returned by Datastore implementations
+var ErrInvalidEmail = errors.New("invalid email address")
+var ErrDuplicateEmail = errors.New("email address already in use")
+var ErrContactNotFound = errors.New("contact not found")
+var ErrVersionConflict = errors.New("contact version conflict")
+var ErrInvalidField = errors.New("invalid contact field")
+var ErrSuppressionNotFound = errors.New("suppression not found")
+var ErrAPIKeyNotFound = errors.New("api key not found")
+var ErrInvalidUser = errors.New("invalid user")
+var ErrDuplicateUser = errors.New("username already in use")
+var ErrUserNotFound = errors.New("user not found")
+var ErrSessionNotFound = errors.New("session not found")
+var ErrDatastoreClosed = errors.New("datastore closed")
+
 type Datastore interface {
 	Status() bool
-	StoreContact(Contact) Contact
+	StoreContact(Contact) (Contact, error)
 	DeleteContact(string) bool
-	UpdateContact(Contact) Contact
+	UpdateContact(Contact) (Contact, error)
+	MergeContacts(string, string) (Contact, error)
+	AddContactTag(string, string) (Contact, error)
+	RemoveContactTag(string, string) (Contact, error)
 	RetrieveContactsBy(string, string) []Contact
+	StoreSuppression(Suppression) (Suppression, error)
+	RetrieveSuppressions() []Suppression
+	RetrieveSuppression(string) (Suppression, error)
+	IsSuppressed(string) (bool, error)
+	DeleteSuppression(string) bool
+	StoreAPIKey(APIKey) (APIKey, error)
+	RetrieveAPIKey(string) (APIKey, error)
+	RetrieveAPIKeys() []APIKey
+	RevokeAPIKey(string) bool
+	StoreUser(User) (User, error)
+	RetrieveUser(string) (User, error)
+	RetrieveUserById(string) (User, error)
+	RetrieveUserBySubject(issuer string, subject string) (User, error)
+	UpdateUser(User) error
+	RetrieveUsers() []User
+	DeleteUser(string) bool
+	StoreSession(Session) error
+	RetrieveSession(string) (Session, error)
+	DeleteSession(string) bool
+	StoreSendRecord(SendRecord) error
+	RetrieveSendRecords(string) []SendRecord
+	IncrementProviderUsage(string, string) error
+	RetrieveProviderUsage(string) map[string]int
+	StoreProviderOverride(ProviderOverride) error
+	RetrieveProviderOverrides() []ProviderOverride
 	Ping() bool
+	WithContext(context.Context) Datastore
+	Close()
 }
 
 type Contact struct {
-	Id    bson.ObjectId `json:"id" bson:"_id,omitempty"`
-	Email string        `json:"email"`
-	Name  string        `json:"name"`
-	Tags  []string      `json:"tags"`
+	Id      bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Email   string        `json:"email"`
+	Name    string        `json:"name"`
+	Tags    []string      `json:"tags"`
+	Fields  ContactFields `json:"fields,omitempty" bson:"fields,omitempty"`
+	Version int           `json:"version"`
+}
+
+// Custom typed attributes of a Contact, e.g. company, locale, plan or
+// signup date. Values are strings, numbers, booleans or times
+type ContactFields map[string]interface{}
+
+// Address which must not be mailed, e.g. after a hard bounce or unsubscribe
+type Suppression struct {
+	Email   string    `json:"email" bson:"_id"`
+	Reason  string    `json:"reason"`
+	Source  string    `json:"source"`
+	Created time.Time `json:"created"`
+}
+
+// Client credential for the API. Only a hash of the key is stored
+type APIKey struct {
+	Id          bson.ObjectId `json:"id" bson:"_id"`
+	Name        string        `json:"name"`
+	Hash        string        `json:"-"`
+	Scopes      []string      `json:"scopes"`
+	AllowedFrom []string      `json:"allowedFrom,omitempty" bson:"allowedFrom,omitempty"`
+	Created     time.Time     `json:"created"`
+	Revoked     bool          `json:"revoked"`
+}
+
+// Account for the web UI
+type User struct {
+	Id           bson.ObjectId `json:"id" bson:"_id"`
+	Username     string        `json:"username"`
+	PasswordHash string        `json:"-"`
+	Roles        []string      `json:"roles"`
+	Created      time.Time     `json:"created"`
+	Issuer       string        `json:"issuer,omitempty" bson:"issuer,omitempty"`   // OpenID Connect issuer of a federated user
+	Subject      string        `json:"subject,omitempty" bson:"subject,omitempty"` // and its subject there
+}
+
+// Login session of a User. Id is the hash of the cookie token
+type Session struct {
+	Id        string        `bson:"_id"`
+	UserId    bson.ObjectId `bson:"userId"`
+	CsrfToken string        `bson:"csrfToken"`
+	Expires   time.Time     `bson:"expires"`
+}
+
+// Record of a message sent by a User
+type SendRecord struct {
+	Id       bson.ObjectId `json:"id" bson:"_id"`
+	UserId   bson.ObjectId `json:"-" bson:"userId"`
+	To       []string      `json:"to"`
+	From     string        `json:"from"`
+	Subject  string        `json:"subject"`
+	Provider string        `json:"provider"`
+	Status   int           `json:"status"`
+	Sent     time.Time     `json:"sent"`
+}
+
+// Manual override of a Mail Server's availability, and of its url and
+// apiKey when changed through PUT /providers
+type ProviderOverride struct {
+	Name      string    `json:"name" bson:"_id"`
+	Mode      string    `json:"mode"`
+	Reason    string    `json:"reason,omitempty"`
+	Url       string    `json:"url,omitempty" bson:"url,omitempty"`
+	ApiKey    string    `json:"-" bson:"-"`
+	SealedKey string    `json:"-" bson:"sealedApiKey,omitempty"`
+	UpdatedBy string    `json:"updatedBy"`
+	Updated   time.Time `json:"updated"`
 }
 
 // Generic Message object
 type Message struct {
-	Id      int      `json:"id"`
-	To      []string `json:"to"`
-	Subject string   `json:"subject"`
-	From    string   `json:"from"`
-	Text    string   `json:"text"`
+	Id      int               `json:"id"`
+	To      []string          `json:"to"`
+	Subject string            `json:"subject"`
+	From    string            `json:"from"`
+	Text    string            `json:"text"`
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
 // Generic Mail Server Configuration
@@ -273,20 +516,57 @@ type MailServer struct {
 	PingUrl string
 	ApiKey  string
 	PingKey string
+	Limits  RateLimit
 }
 
 // Structure for Applications Configuration
 type Config struct {
-	MailServers   []MailServer
-	PingPeriod    int
-	EmailThrottle int
-	LogFileName   string
+	Port                 string
+	MailServers          []MailServer
+	PingPeriod           int
+	ShutdownTimeout      int
+	ShutdownDrainSeconds int
+	EmailThrottle        int
+	RateLimits           RateLimitConfig
+	LogFileName          string
+	LogRotation          LogRotation
+	Tracing              TracingConfig
+	LogLevel             string
+	LogFormat            string
+	LogMessageBodies     bool
+	BaseUrl              string
+	UnsubscribeSecret    string
+	ProviderKeySecret    string
+	MongoUrl             string
+	Vault                VaultConfig
+	TLS                  TLSConfig
+	OIDC                 OIDCConfig
+	Roles                map[string]RolePolicy
 }
 
-// Structure of Server Status
+// What members of a role may do. AllowedFrom restricts the From addresses
+// ("me@example.com") or domains ("example.com") for sending
+type RolePolicy struct {
+	Scopes      []string
+	AllowedFrom []string
+}
+
+// Status of a Mail Server as reported by /status
 type Status struct {
-	ServerStatus []struct {
-		Name   string
-		Status bool
-	}
+	Up                  bool       `json:"up"`
+	DailyLimit          int        `json:"dailyLimit,omitempty"`
+	DailyRemaining      *int       `json:"dailyRemaining,omitempty"`
+	RateLimited         bool       `json:"rateLimited"`
+	LastPing            *time.Time `json:"lastPing,omitempty"`
+	LastPingLatencyMs   float64    `json:"lastPingLatencyMs"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastErrorAt         *time.Time `json:"lastErrorAt,omitempty"`
+	Mode                string     `json:"mode"`
+	InFlight            int        `json:"inFlight"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	RecentSends         int        `json:"recentSends"`
+	SendSuccessRate     *float64   `json:"sendSuccessRate,omitempty"`
+	Circuit             string     `json:"circuit"`
+	UptimeHour          *float64   `json:"uptimeHour,omitempty"`
+	UptimeDay           *float64   `json:"uptimeDay,omitempty"`
 }
@@ -2,15 +2,17 @@
 
 package main
 
+import (
+	"context"
+)
+
 type AwsServer struct {
 	Server MailServer
 }
 
-func (s *AwsServer) Send(message Message) int {
+func (s *AwsServer) Send(ctx context.Context, message Message) int {
 	// TODO Implement
-	if Debug {
-		InfoLog.Printf("sending email from %s to %s with subject %s via AWS.\n", message.From, message.To, message.Subject)
-	}
+	logFrom(ctx).Debug("Sending email", "provider", "AWS", "from", message.From, "to", message.To, "subject", message.Subject)
 	return 500
 }
 
@@ -4,21 +4,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"net/http"
 	"net/url"
 	"strconv"
 )
 
-var mailGunKey string
-
 type MailGunServer struct {
 	Server MailServer
 }
 
-func (s *MailGunServer) Send(message Message) int {
-	if Debug {
-		InfoLog.Printf("sending email from %s to %s with subject %s via MailGun.\n", message.From, message.To, message.Subject)
-	}
+func (s *MailGunServer) Send(ctx context.Context, message Message) int {
+	ctx, span := startSpan(ctx, "MailGun POST messages", SpanKindClient, "provider", "MailGun")
+	defer span.End()
+	log := logFrom(ctx)
+
+	log.Debug("Sending email", "provider", "MailGun", "from", message.From, "to", message.To, "subject", message.Subject)
 
 	data := url.Values{}
 	data.Set("from", message.From)
@@ -27,25 +28,28 @@ func (s *MailGunServer) Send(message Message) int {
 	}
 	data.Set("subject", message.Subject)
 	data.Set("text", message.Text)
+	for name, value := range message.Headers {
+		data.Set("h:"+name, value)
+	}
 
 	r, err := http.NewRequest("POST", s.Server.Url+"messages", bytes.NewBufferString(data.Encode()))
 	check(err)
-	r.SetBasicAuth("api", mailGunKey)
+	r.SetBasicAuth("api", s.Server.ApiKey)
 	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	r.Header.Add("Content-Length", strconv.Itoa(len(data.Encode())))
+	r = tracedRequest(ctx, r)
 
-	if Debug {
-		InfoLog.Println("Sending Request " + r.URL.String())
-	}
+	log.Debug("Sending Request", "url", r.URL.String())
 	res, err := http.DefaultClient.Do(r)
 	if err != nil {
-		ErrorLog.Println("Error sending mail via MailGun", err)
+		log.Error("Error sending mail via MailGun", "error", err)
+		span.SetError(err)
 		return 500
 	}
+	defer res.Body.Close()
+	span.SetHTTPStatus(res.StatusCode)
 
-	if Debug {
-		InfoLog.Println("Received: " + res.Status)
-	}
+	log.Debug("Received", "provider", "MailGun", "status", res.Status)
 	return res.StatusCode
 }
 
@@ -53,20 +57,16 @@ func (s *MailGunServer) Ping() bool {
 
 	r, err := http.NewRequest("GET", s.Server.Url+"stats", nil)
 	check(err)
-	r.SetBasicAuth("api", mailGunKey)
+	r.SetBasicAuth("api", s.Server.ApiKey)
 
-	if Debug {
-		InfoLog.Println("Sending Request " + r.URL.String())
-	}
+	Log.Debug("Sending Request", "url", r.URL.String())
 	res, err := http.DefaultClient.Do(r)
 	if err != nil {
-		ErrorLog.Println("Error reaching MailGun server ", err)
+		Log.Warn("Error reaching MailGun server", "error", err)
 		return false
 	}
 
-	if Debug {
-		ErrorLog.Println("Received: " + res.Status)
-	}
+	Log.Debug("Received", "provider", "MailGun", "status", res.Status)
 
 	return res.StatusCode == 200
 }
@@ -76,6 +76,6 @@ func (s *MailGunServer) GetName() string {
 }
 
 func (s *MailGunServer) SetKey(key string) {
-	mailGunKey = key
+	s.Server.ApiKey = key
 	return
 }
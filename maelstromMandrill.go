@@ -4,22 +4,26 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 )
 
-var mandrillKey string
-
 type MandrillServer struct {
 	Server MailServer
 }
 
-func (s *MandrillServer) Send(message Message) int {
-	mail := MandrillMail{Key: mandrillKey}
+func (s *MandrillServer) Send(ctx context.Context, message Message) int {
+	ctx, span := startSpan(ctx, "Mandrill POST messages/send", SpanKindClient, "provider", "Mandrill")
+	defer span.End()
+	log := logFrom(ctx)
+
+	mail := MandrillMail{Key: s.Server.ApiKey}
 	mail.Message.Text = message.Text
 	mail.Message.Subject = message.Subject
 	mail.Message.From = message.From
+	mail.Message.Headers = message.Headers
 	mail.Message.To = make([]MandrillTo, len(message.To))
 	for i, to := range message.To {
 		mail.Message.To[i] = MandrillTo{Email: to}
@@ -30,37 +34,33 @@ func (s *MandrillServer) Send(message Message) int {
 	r, err := http.NewRequest("POST", s.Server.Url+"messages/send.json", bytes.NewBuffer(jsonBuff))
 	check(err)
 	r.Header.Add("Content-Type", "application/json")
+	r = tracedRequest(ctx, r)
 	res, err := http.DefaultClient.Do(r)
 	if err != nil {
-		ErrorLog.Println("Error sending mail via Mandrill ", err)
+		log.Error("Error sending mail via Mandrill", "error", err)
+		span.SetError(err)
 		return 500
 	}
+	defer res.Body.Close()
+	span.SetHTTPStatus(res.StatusCode)
 
-	if Debug {
-		InfoLog.Println("Received: " + res.Status)
-	}
+	log.Debug("Received", "provider", "Mandrill", "status", res.Status)
 	return res.StatusCode
 }
 
 func (s *MandrillServer) Ping() bool {
 
-	var jsonStr = []byte(`{"key":"` + mandrillKey + `"}`)
-	if Debug {
-		InfoLog.Println("Sending Request " + s.Server.Url + "users/ping.json")
-	}
+	var jsonStr = []byte(`{"key":"` + s.Server.ApiKey + `"}`)
+	Log.Debug("Sending Request", "url", s.Server.Url+"users/ping.json")
 	res, err := http.Post(s.Server.Url+"users/ping.json", "application/json", bytes.NewBuffer(jsonStr))
 	if err != nil {
-		if Debug {
-			ErrorLog.Println("Mandrill ping failed: ", err)
-		}
+		Log.Warn("Mandrill ping failed", "error", err)
 		return false
 	}
 	defer res.Body.Close()
 	body, err := ioutil.ReadAll(res.Body)
 	if string(body) != `"PONG!"` {
-		if Debug {
-			ErrorLog.Println("Mandrill Ping failed with response: " + string(body))
-		}
+		Log.Warn("Mandrill ping failed", "response", string(body))
 		return false
 	}
 	return true
@@ -71,17 +71,18 @@ func (s *MandrillServer) GetName() string {
 }
 
 func (s *MandrillServer) SetKey(key string) {
-	mandrillKey = key
+	s.Server.ApiKey = key
 	return
 }
 
 type MandrillMail struct {
 	Key     string `json:"key"`
 	Message struct {
-		Text    string       `json:"text"`
-		Subject string       `json:"subject"`
-		From    string       `json:"from_email"`
-		To      []MandrillTo `json:"to"`
+		Text    string            `json:"text"`
+		Subject string            `json:"subject"`
+		From    string            `json:"from_email"`
+		To      []MandrillTo      `json:"to"`
+		Headers map[string]string `json:"headers,omitempty"`
 	} `json:"message"`
 }
 
@@ -1,64 +1,237 @@
 package main
 
 import (
-	"google.golang.org/cloud/compute/metadata"
+	"context"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"sync"
+	"time"
 )
 
 var mongoUrl string = "localhost:27017"
 var dbName string = "test"
 
-type MongoDatastore struct{}
+// Connection to MongoDB shared by every request's view of the datastore
+type mongoConnection struct {
+	lock   sync.Mutex
+	master *mgo.Session
+	closed bool
+}
 
-func (db *MongoDatastore) Ping() bool {
-	if gce {
-		mongoUrl, _ = metadata.InstanceAttributeValue("mongoUrl")
-		if Debug {
-			InfoLog.Println("Mongo URL pulled from GCE Metadata: " + mongoUrl)
+type MongoDatastore struct {
+	*mongoConnection
+	ctx context.Context
+}
+
+func NewMongoDatastore() *MongoDatastore {
+	return &MongoDatastore{&mongoConnection{}, context.Background()}
+}
+
+// The datastore logging with the ID and trace of the request handled in ctx
+func (db *MongoDatastore) WithContext(ctx context.Context) Datastore {
+	return &MongoDatastore{db.mongoConnection, ctx}
+}
+
+// Copy of the shared session, dialling MongoDB on first use. The copy
+// must be closed
+func (db *MongoDatastore) session() (*mgo.Session, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.closed {
+		return nil, ErrDatastoreClosed
+	}
+	if db.master == nil {
+		master, err := mgo.Dial(mongoUrl)
+		if err != nil {
+			return nil, err
 		}
+		db.master = master
 	}
-	session, err := mgo.Dial(mongoUrl)
+	return db.master.Copy(), nil
+}
+
+// Close the shared session, later operations fail
+func (db *MongoDatastore) Close() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.closed = true
+	if db.master != nil {
+		db.master.Close()
+		db.master = nil
+	}
+}
+
+func (db *MongoDatastore) Ping() bool {
+	defer observeDatastore("Ping", time.Now())
+
+	session, err := db.session()
 	if err != nil {
 		return false
 	}
-	session.Close()
-	return true
+	defer session.Close()
+	return session.Ping() == nil
 }
 
-func (db *MongoDatastore) StoreContact(contact Contact) Contact {
-	session, err := mgo.Dial(mongoUrl)
-	check(err)
+func (db *MongoDatastore) StoreContact(contact Contact) (Contact, error) {
+	defer observeDatastore("StoreContact", time.Now())
+
+	if err := normalizeContact(&contact); err != nil {
+		return Contact{}, err
+	}
+
+	session, err := db.session()
+	if err != nil {
+		return Contact{}, err
+	}
 	defer session.Close()
 
-	contact.Id = bson.NewObjectId()
 	c := session.DB(dbName).C("contact")
+	db.ensureContactIndex(c)
+
+	count, err := c.Find(bson.M{"email": contact.Email}).Count()
+	if err == nil && count > 0 {
+		return Contact{}, ErrDuplicateEmail
+	}
+
+	contact.Id = bson.NewObjectId()
+	contact.Version = 1
 	err = c.Insert(&contact)
+	if mgo.IsDup(err) {
+		return Contact{}, ErrDuplicateEmail
+	}
 	if err != nil {
-		ErrorLog.Println("Error storing Contact: " + contact.Name)
-		return Contact{}
+		logFrom(db.ctx).Error("Error storing Contact", "name", contact.Name, "error", err)
+		return Contact{}, err
 	}
 
-	return contact
+	return contact, nil
 }
 
-func (db *MongoDatastore) UpdateContact(contact Contact) Contact {
-	session, err := mgo.Dial(mongoUrl)
-	check(err)
+// Update the contact if its stored Version still matches contact.Version
+func (db *MongoDatastore) UpdateContact(contact Contact) (Contact, error) {
+	defer observeDatastore("UpdateContact", time.Now())
+
+	if err := normalizeContact(&contact); err != nil {
+		return Contact{}, err
+	}
+
+	session, err := db.session()
+	if err != nil {
+		return Contact{}, err
+	}
 	defer session.Close()
 
 	c := session.DB(dbName).C("contact")
-	err = c.UpdateId(contact.Id, &contact)
+	db.ensureContactIndex(c)
+
+	count, err := c.Find(bson.M{"email": contact.Email, "_id": bson.M{"$ne": contact.Id}}).Count()
+	if err == nil && count > 0 {
+		return Contact{}, ErrDuplicateEmail
+	}
+
+	expected := contact.Version
+	contact.Version = expected + 1
+	err = c.Update(bson.M{"_id": contact.Id, "version": versionSelector(expected)}, &contact)
+	if err == mgo.ErrNotFound {
+		count, _ := c.FindId(contact.Id).Count()
+		if count == 0 {
+			return Contact{}, ErrContactNotFound
+		}
+		return Contact{}, ErrVersionConflict
+	}
+	if mgo.IsDup(err) {
+		return Contact{}, ErrDuplicateEmail
+	}
 	if err != nil {
-		return Contact{}
+		return Contact{}, err
 	}
 
-	return contact
+	return contact, nil
+}
+
+func (db *MongoDatastore) AddContactTag(id string, tag string) (Contact, error) {
+	defer observeDatastore("AddContactTag", time.Now())
+
+	return db.applyContactChange(id, bson.M{"$addToSet": bson.M{"tags": tag}, "$inc": bson.M{"version": 1}})
+}
+
+func (db *MongoDatastore) RemoveContactTag(id string, tag string) (Contact, error) {
+	defer observeDatastore("RemoveContactTag", time.Now())
+
+	return db.applyContactChange(id, bson.M{"$pull": bson.M{"tags": tag}, "$inc": bson.M{"version": 1}})
+}
+
+// Atomically apply an update to a single contact and return the result
+func (db *MongoDatastore) applyContactChange(id string, update bson.M) (Contact, error) {
+	session, err := db.session()
+	if err != nil {
+		return Contact{}, err
+	}
+	defer session.Close()
+
+	c := session.DB(dbName).C("contact")
+
+	contact := Contact{}
+	_, err = c.FindId(bson.ObjectIdHex(id)).Apply(mgo.Change{Update: update, ReturnNew: true}, &contact)
+	if err == mgo.ErrNotFound {
+		return Contact{}, ErrContactNotFound
+	}
+	if err != nil {
+		return Contact{}, err
+	}
+
+	return contact, nil
+}
+
+// Merge the source contact into the target and remove the source
+func (db *MongoDatastore) MergeContacts(targetId string, sourceId string) (Contact, error) {
+	defer observeDatastore("MergeContacts", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		return Contact{}, err
+	}
+	defer session.Close()
+
+	c := session.DB(dbName).C("contact")
+
+	target := Contact{}
+	source := Contact{}
+	if c.FindId(bson.ObjectIdHex(targetId)).One(&target) != nil {
+		return Contact{}, ErrContactNotFound
+	}
+	if c.FindId(bson.ObjectIdHex(sourceId)).One(&source) != nil {
+		return Contact{}, ErrContactNotFound
+	}
+
+	merged := mergeContacts(target, source)
+	merged.Version = target.Version + 1
+	err = c.Update(bson.M{"_id": merged.Id, "version": versionSelector(target.Version)}, &merged)
+	if err == mgo.ErrNotFound {
+		return Contact{}, ErrVersionConflict
+	}
+	if err != nil {
+		return Contact{}, err
+	}
+	err = c.RemoveId(source.Id)
+	if err != nil {
+		logFrom(db.ctx).Error("Error removing merged Contact", "id", sourceId, "error", err)
+	}
+
+	return merged, nil
 }
 
 func (db *MongoDatastore) RetrieveContactsBy(param string, value string) []Contact {
-	session, err := mgo.Dial(mongoUrl)
-	check(err)
+	defer observeDatastore("RetrieveContactsBy", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		logFrom(db.ctx).Error("Error retrieving Contacts", "error", err)
+		return []Contact{}
+	}
 	defer session.Close()
 
 	c := session.DB(dbName).C("contact")
@@ -70,18 +243,23 @@ func (db *MongoDatastore) RetrieveContactsBy(param string, value string) []Conta
 		oid := bson.ObjectIdHex(value)
 		err = c.FindId(oid).One(&contact)
 		if err != nil {
-			if Debug {
-				InfoLog.Printf("Cannot retrieve contact where %s = %s \n", param, value)
-			}
+			logFrom(db.ctx).Debug("Cannot retrieve contact", "param", param, "value", value)
+			return []Contact{}
 		}
 		result = make([]Contact, 1, 1)
 		result[0] = contact
 	} else {
-		err = c.Find(bson.M{param: value}).All(&result)
+		var query bson.M
+		if param == "tag" {
+			query = bson.M{"tags": value}
+		} else if strings.HasPrefix(param, "fields.") {
+			query = bson.M{param: bson.M{"$in": fieldQueryValues(value)}}
+		} else {
+			query = bson.M{param: value}
+		}
+		err = c.Find(query).All(&result)
 		if err != nil {
-			if Debug {
-				InfoLog.Printf("Cannot retrieve contact where %s = %s \n", param, value)
-			}
+			logFrom(db.ctx).Debug("Cannot retrieve contact", "param", param, "value", value)
 			return []Contact{}
 		}
 	}
@@ -89,8 +267,13 @@ func (db *MongoDatastore) RetrieveContactsBy(param string, value string) []Conta
 }
 
 func (db *MongoDatastore) DeleteContact(id string) bool {
-	session, err := mgo.Dial(mongoUrl)
-	check(err)
+	defer observeDatastore("DeleteContact", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		logFrom(db.ctx).Error("Error connecting to MongoDB", "operation", "DeleteContact", "error", err)
+		return false
+	}
 	defer session.Close()
 
 	objectId := bson.ObjectIdHex(id)
@@ -103,6 +286,517 @@ func (db *MongoDatastore) DeleteContact(id string) bool {
 	return true
 }
 
+func (db *MongoDatastore) StoreSuppression(suppression Suppression) (Suppression, error) {
+	defer observeDatastore("StoreSuppression", time.Now())
+
+	if err := normalizeSuppression(&suppression); err != nil {
+		return Suppression{}, err
+	}
+
+	session, err := db.session()
+	if err != nil {
+		return Suppression{}, err
+	}
+	defer session.Close()
+
+	c := session.DB(dbName).C("suppression")
+	_, err = c.UpsertId(suppression.Email, &suppression)
+	if err != nil {
+		logFrom(db.ctx).Error("Error storing Suppression", "email", suppression.Email, "error", err)
+		return Suppression{}, err
+	}
+
+	return suppression, nil
+}
+
+func (db *MongoDatastore) RetrieveSuppressions() []Suppression {
+	defer observeDatastore("RetrieveSuppressions", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		logFrom(db.ctx).Error("Error retrieving Suppressions", "error", err)
+		return []Suppression{}
+	}
+	defer session.Close()
+
+	result := []Suppression{}
+	c := session.DB(dbName).C("suppression")
+	err = c.Find(nil).Sort("-created").All(&result)
+	if err != nil {
+		logFrom(db.ctx).Error("Error retrieving Suppressions", "error", err)
+		return []Suppression{}
+	}
+
+	return result
+}
+
+func (db *MongoDatastore) RetrieveSuppression(email string) (Suppression, error) {
+	defer observeDatastore("RetrieveSuppression", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		return Suppression{}, err
+	}
+	defer session.Close()
+
+	result := Suppression{}
+	c := session.DB(dbName).C("suppression")
+	err = c.FindId(email).One(&result)
+	if err == mgo.ErrNotFound {
+		return Suppression{}, ErrSuppressionNotFound
+	}
+	if err != nil {
+		return Suppression{}, err
+	}
+
+	return result, nil
+}
+
+func (db *MongoDatastore) IsSuppressed(email string) (bool, error) {
+	defer observeDatastore("IsSuppressed", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+
+	c := session.DB(dbName).C("suppression")
+	count, err := c.FindId(email).Count()
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (db *MongoDatastore) DeleteSuppression(email string) bool {
+	defer observeDatastore("DeleteSuppression", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		logFrom(db.ctx).Error("Error connecting to MongoDB", "operation", "DeleteSuppression", "error", err)
+		return false
+	}
+	defer session.Close()
+
+	c := session.DB(dbName).C("suppression")
+	err = c.RemoveId(email)
+	if err != nil {
+		return false
+	}
+
+	return true
+}
+
+func (db *MongoDatastore) StoreAPIKey(key APIKey) (APIKey, error) {
+	defer observeDatastore("StoreAPIKey", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		return APIKey{}, err
+	}
+	defer session.Close()
+
+	c := session.DB(dbName).C("apikey")
+	err = c.Insert(&key)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return key, nil
+}
+
+func (db *MongoDatastore) RetrieveAPIKey(id string) (APIKey, error) {
+	defer observeDatastore("RetrieveAPIKey", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		return APIKey{}, err
+	}
+	defer session.Close()
+
+	key := APIKey{}
+	c := session.DB(dbName).C("apikey")
+	err = c.FindId(bson.ObjectIdHex(id)).One(&key)
+	if err == mgo.ErrNotFound {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return key, nil
+}
+
+func (db *MongoDatastore) RetrieveAPIKeys() []APIKey {
+	defer observeDatastore("RetrieveAPIKeys", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		logFrom(db.ctx).Error("Error retrieving API keys", "error", err)
+		return []APIKey{}
+	}
+	defer session.Close()
+
+	result := []APIKey{}
+	c := session.DB(dbName).C("apikey")
+	err = c.Find(nil).Sort("created").All(&result)
+	if err != nil {
+		logFrom(db.ctx).Error("Error retrieving API keys", "error", err)
+		return []APIKey{}
+	}
+
+	return result
+}
+
+func (db *MongoDatastore) RevokeAPIKey(id string) bool {
+	defer observeDatastore("RevokeAPIKey", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		logFrom(db.ctx).Error("Error connecting to MongoDB", "operation", "RevokeAPIKey", "error", err)
+		return false
+	}
+	defer session.Close()
+
+	c := session.DB(dbName).C("apikey")
+	err = c.UpdateId(bson.ObjectIdHex(id), bson.M{"$set": bson.M{"revoked": true}})
+	if err != nil {
+		return false
+	}
+
+	return true
+}
+
+func (db *MongoDatastore) StoreUser(user User) (User, error) {
+	defer observeDatastore("StoreUser", time.Now())
+
+	if err := normalizeUser(&user); err != nil {
+		return User{}, err
+	}
+
+	session, err := db.session()
+	if err != nil {
+		return User{}, err
+	}
+	defer session.Close()
+
+	c := session.DB(dbName).C("user")
+	err = c.EnsureIndex(mgo.Index{Key: []string{"username"}, Unique: true})
+	if err != nil {
+		logFrom(db.ctx).Warn("Error ensuring username index", "error", err)
+	}
+	err = c.EnsureIndex(mgo.Index{Key: []string{"issuer", "subject"}, Unique: true, Sparse: true})
+	if err != nil {
+		logFrom(db.ctx).Warn("Error ensuring subject index", "error", err)
+	}
+	err = c.Insert(&user)
+	if mgo.IsDup(err) {
+		return User{}, ErrDuplicateUser
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (db *MongoDatastore) RetrieveUser(username string) (User, error) {
+	defer observeDatastore("RetrieveUser", time.Now())
+
+	return db.findUser(bson.M{"username": strings.ToLower(strings.TrimSpace(username))})
+}
+
+func (db *MongoDatastore) RetrieveUserById(id string) (User, error) {
+	defer observeDatastore("RetrieveUserById", time.Now())
+
+	if !bson.IsObjectIdHex(id) {
+		return User{}, ErrUserNotFound
+	}
+	return db.findUser(bson.M{"_id": bson.ObjectIdHex(id)})
+}
+
+func (db *MongoDatastore) RetrieveUserBySubject(issuer string, subject string) (User, error) {
+	defer observeDatastore("RetrieveUserBySubject", time.Now())
+
+	return db.findUser(bson.M{"issuer": issuer, "subject": subject})
+}
+
+func (db *MongoDatastore) findUser(query bson.M) (User, error) {
+	session, err := db.session()
+	if err != nil {
+		return User{}, err
+	}
+	defer session.Close()
+
+	user := User{}
+	c := session.DB(dbName).C("user")
+	err = c.Find(query).One(&user)
+	if err == mgo.ErrNotFound {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (db *MongoDatastore) UpdateUser(user User) error {
+	defer observeDatastore("UpdateUser", time.Now())
+
+	if err := normalizeUser(&user); err != nil {
+		return err
+	}
+
+	session, err := db.session()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = session.DB(dbName).C("user").UpdateId(user.Id, &user)
+	if err == mgo.ErrNotFound {
+		return ErrUserNotFound
+	}
+	if mgo.IsDup(err) {
+		return ErrDuplicateUser
+	}
+
+	return err
+}
+
+func (db *MongoDatastore) RetrieveUsers() []User {
+	defer observeDatastore("RetrieveUsers", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		logFrom(db.ctx).Error("Error retrieving Users", "error", err)
+		return []User{}
+	}
+	defer session.Close()
+
+	result := []User{}
+	c := session.DB(dbName).C("user")
+	err = c.Find(nil).Sort("username").All(&result)
+	if err != nil {
+		logFrom(db.ctx).Error("Error retrieving Users", "error", err)
+		return []User{}
+	}
+
+	return result
+}
+
+func (db *MongoDatastore) DeleteUser(id string) bool {
+	defer observeDatastore("DeleteUser", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		logFrom(db.ctx).Error("Error connecting to MongoDB", "operation", "DeleteUser", "error", err)
+		return false
+	}
+	defer session.Close()
+
+	objectId := bson.ObjectIdHex(id)
+	err = session.DB(dbName).C("user").RemoveId(objectId)
+	if err != nil {
+		return false
+	}
+	session.DB(dbName).C("session").RemoveAll(bson.M{"userId": objectId})
+
+	return true
+}
+
+func (db *MongoDatastore) StoreSession(s Session) error {
+	defer observeDatastore("StoreSession", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB(dbName).C("session")
+	// Let Mongo remove expired sessions
+	err = c.EnsureIndex(mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second})
+	if err != nil {
+		logFrom(db.ctx).Warn("Error ensuring session expiry index", "error", err)
+	}
+
+	return c.Insert(&s)
+}
+
+func (db *MongoDatastore) RetrieveSession(id string) (Session, error) {
+	defer observeDatastore("RetrieveSession", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		return Session{}, err
+	}
+	defer session.Close()
+
+	result := Session{}
+	err = session.DB(dbName).C("session").FindId(id).One(&result)
+	if err == mgo.ErrNotFound {
+		return Session{}, ErrSessionNotFound
+	}
+	if err != nil {
+		return Session{}, err
+	}
+
+	return result, nil
+}
+
+func (db *MongoDatastore) DeleteSession(id string) bool {
+	defer observeDatastore("DeleteSession", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		logFrom(db.ctx).Error("Error connecting to MongoDB", "operation", "DeleteSession", "error", err)
+		return false
+	}
+	defer session.Close()
+
+	err = session.DB(dbName).C("session").RemoveId(id)
+	if err != nil {
+		return false
+	}
+
+	return true
+}
+
+func (db *MongoDatastore) StoreSendRecord(record SendRecord) error {
+	defer observeDatastore("StoreSendRecord", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	return session.DB(dbName).C("history").Insert(&record)
+}
+
+func (db *MongoDatastore) RetrieveSendRecords(userId string) []SendRecord {
+	defer observeDatastore("RetrieveSendRecords", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		logFrom(db.ctx).Error("Error retrieving send history", "error", err)
+		return []SendRecord{}
+	}
+	defer session.Close()
+
+	result := []SendRecord{}
+	c := session.DB(dbName).C("history")
+	err = c.Find(bson.M{"userId": bson.ObjectIdHex(userId)}).Sort("-sent").Limit(100).All(&result)
+	if err != nil {
+		logFrom(db.ctx).Error("Error retrieving send history", "error", err)
+		return []SendRecord{}
+	}
+
+	return result
+}
+
+func (db *MongoDatastore) IncrementProviderUsage(name string, day string) error {
+	defer observeDatastore("IncrementProviderUsage", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB(dbName).C("usage")
+	_, err = c.UpsertId(name+":"+day, bson.M{
+		"$set": bson.M{"provider": name, "day": day},
+		"$inc": bson.M{"count": 1},
+	})
+
+	return err
+}
+
+func (db *MongoDatastore) RetrieveProviderUsage(day string) map[string]int {
+	defer observeDatastore("RetrieveProviderUsage", time.Now())
+
+	result := make(map[string]int)
+	session, err := db.session()
+	if err != nil {
+		logFrom(db.ctx).Error("Error retrieving provider usage", "error", err)
+		return result
+	}
+	defer session.Close()
+
+	var usage []struct {
+		Provider string
+		Count    int
+	}
+	c := session.DB(dbName).C("usage")
+	err = c.Find(bson.M{"day": day}).All(&usage)
+	if err != nil {
+		logFrom(db.ctx).Error("Error retrieving provider usage", "error", err)
+		return result
+	}
+	for _, u := range usage {
+		result[u.Provider] = u.Count
+	}
+
+	return result
+}
+
+func (db *MongoDatastore) StoreProviderOverride(override ProviderOverride) error {
+	defer observeDatastore("StoreProviderOverride", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	c := session.DB(dbName).C("provider")
+	_, err = c.UpsertId(override.Name, &override)
+
+	return err
+}
+
+func (db *MongoDatastore) RetrieveProviderOverrides() []ProviderOverride {
+	defer observeDatastore("RetrieveProviderOverrides", time.Now())
+
+	session, err := db.session()
+	if err != nil {
+		logFrom(db.ctx).Error("Error retrieving provider overrides", "error", err)
+		return []ProviderOverride{}
+	}
+	defer session.Close()
+
+	var result []ProviderOverride
+	c := session.DB(dbName).C("provider")
+	err = c.Find(nil).All(&result)
+	if err != nil {
+		logFrom(db.ctx).Error("Error retrieving provider overrides", "error", err)
+		return []ProviderOverride{}
+	}
+
+	return result
+}
+
 func (db *MongoDatastore) Status() bool {
 	return true
 }
+
+// Ensure email addresses are unique across contacts
+func (db *MongoDatastore) ensureContactIndex(c *mgo.Collection) {
+	err := c.EnsureIndex(mgo.Index{Key: []string{"email"}, Unique: true})
+	if err != nil {
+		logFrom(db.ctx).Warn("Error ensuring contact email index", "error", err)
+	}
+}
+
+// Match a stored version, treating contacts saved before versioning as 0
+func versionSelector(version int) interface{} {
+	if version == 0 {
+		return bson.M{"$in": []interface{}{0, nil}}
+	}
+	return version
+}
@@ -2,20 +2,22 @@
 
 package main
 
+import (
+	"context"
+)
+
 type SendGridServer struct {
 	Server MailServer
 }
 
-func (s *SendGridServer) Send(message Message) int {
+func (s *SendGridServer) Send(ctx context.Context, message Message) int {
 	// TODO implement
-	if Debug {
-		InfoLog.Printf("sending email from %s to %s with subject %s via SendGrid.\n", message.From, message.To, message.Subject)
-	}
+	logFrom(ctx).Debug("Sending email", "provider", "SendGrid", "from", message.From, "to", message.To, "subject", message.Subject)
 	return 500
 }
 
 func (s *SendGridServer) Ping() bool {
-	InfoLog.Println("Pinging SendGrid")
+	Log.Debug("Pinging SendGrid")
 
 	// TODO implement
 	return false
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -12,7 +16,7 @@ func TestPinger(t *testing.T) {
 	// Setup
 	config = buildTestConfig()
 	buildServersMap()
-	Debug = true
+	setLogLevel(LevelDebug)
 
 	initiatePing()
 
@@ -51,14 +55,15 @@ func TestChooseMailSender(t *testing.T) {
 	config = buildTestConfig()
 	buildServersMap()
 	initiatePing()
+	defer close(quit)
 
 	// Add Mock
 	mockServer := &MockServer{}
-	Servers[mockServer] = true
+	setServerStatus(Servers, mockServer, true)
 
 	time.Sleep(1 * time.Second)
 
-	s := chooseMailSender()
+	s := chooseMailSender(context.Background(), 1)
 	if s == nil {
 		t.Errorf("chooseMailSender returned nil should be ")
 	}
@@ -69,7 +74,7 @@ func TestChooseMailSenderEmpty(t *testing.T) {
 	fmt.Println("Running Test: TestChooseMailSenderEmpty")
 
 	Servers = make(map[MailSender]bool)
-	s := chooseMailSender()
+	s := chooseMailSender(context.Background(), 1)
 	if s != nil {
 		t.Errorf("chooseMailSender returned %s should be nil.", s.GetName())
 	}
@@ -107,11 +112,9 @@ type MockServer struct {
 	Server MailServer
 }
 
-func (s *MockServer) Send(message Message) int {
+func (s *MockServer) Send(ctx context.Context, message Message) int {
 	// TODO Implement
-	if Debug {
-		InfoLog.Printf("sending email from %s to %s with subject %s via Mock.\n", message.From, message.To, message.Subject)
-	}
+	Log.Debug("Sending email", "provider", "Mock", "from", message.From, "to", message.To, "subject", message.Subject)
 	return 200
 }
 
@@ -126,3 +129,364 @@ func (s *MockServer) GetName() string {
 func (s *MockServer) SetKey(key string) {
 	return
 }
+
+// In memory Datastore
+type MockDatastore struct {
+	contacts     map[bson.ObjectId]Contact
+	suppressions map[string]Suppression
+	apiKeys      map[string]APIKey
+	users        map[bson.ObjectId]User
+	sessions     map[string]Session
+	history      []SendRecord
+	usage        map[string]int
+	overrides    map[string]ProviderOverride
+	closed       bool
+}
+
+func NewMockDatastore() *MockDatastore {
+	return &MockDatastore{
+		contacts:     make(map[bson.ObjectId]Contact),
+		suppressions: make(map[string]Suppression),
+		apiKeys:      make(map[string]APIKey),
+		users:        make(map[bson.ObjectId]User),
+		sessions:     make(map[string]Session),
+		usage:        make(map[string]int),
+		overrides:    make(map[string]ProviderOverride),
+	}
+}
+
+func (db *MockDatastore) Status() bool {
+	return true
+}
+
+func (db *MockDatastore) Ping() bool {
+	return !db.closed
+}
+
+func (db *MockDatastore) WithContext(ctx context.Context) Datastore {
+	return db
+}
+
+func (db *MockDatastore) Close() {
+	db.closed = true
+}
+
+func (db *MockDatastore) emailInUse(email string, id bson.ObjectId) bool {
+	for _, c := range db.contacts {
+		if c.Email == email && c.Id != id {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *MockDatastore) StoreContact(contact Contact) (Contact, error) {
+	if err := normalizeContact(&contact); err != nil {
+		return Contact{}, err
+	}
+	if db.emailInUse(contact.Email, "") {
+		return Contact{}, ErrDuplicateEmail
+	}
+	contact.Id = bson.NewObjectId()
+	contact.Version = 1
+	db.contacts[contact.Id] = contact
+	return contact, nil
+}
+
+func (db *MockDatastore) UpdateContact(contact Contact) (Contact, error) {
+	if err := normalizeContact(&contact); err != nil {
+		return Contact{}, err
+	}
+	if db.emailInUse(contact.Email, contact.Id) {
+		return Contact{}, ErrDuplicateEmail
+	}
+	current, ok := db.contacts[contact.Id]
+	if !ok {
+		return Contact{}, ErrContactNotFound
+	}
+	if current.Version != contact.Version {
+		return Contact{}, ErrVersionConflict
+	}
+	contact.Version++
+	db.contacts[contact.Id] = contact
+	return contact, nil
+}
+
+func (db *MockDatastore) AddContactTag(id string, tag string) (Contact, error) {
+	contact, ok := db.contacts[bson.ObjectIdHex(id)]
+	if !ok {
+		return Contact{}, ErrContactNotFound
+	}
+	contact = mergeContacts(contact, Contact{Tags: []string{tag}})
+	contact.Version++
+	db.contacts[contact.Id] = contact
+	return contact, nil
+}
+
+func (db *MockDatastore) RemoveContactTag(id string, tag string) (Contact, error) {
+	contact, ok := db.contacts[bson.ObjectIdHex(id)]
+	if !ok {
+		return Contact{}, ErrContactNotFound
+	}
+	tags := []string{}
+	for _, t := range contact.Tags {
+		if t != tag {
+			tags = append(tags, t)
+		}
+	}
+	contact.Tags = tags
+	contact.Version++
+	db.contacts[contact.Id] = contact
+	return contact, nil
+}
+
+func (db *MockDatastore) MergeContacts(targetId string, sourceId string) (Contact, error) {
+	target, ok := db.contacts[bson.ObjectIdHex(targetId)]
+	if !ok {
+		return Contact{}, ErrContactNotFound
+	}
+	source, ok := db.contacts[bson.ObjectIdHex(sourceId)]
+	if !ok {
+		return Contact{}, ErrContactNotFound
+	}
+	merged := mergeContacts(target, source)
+	merged.Version++
+	db.contacts[merged.Id] = merged
+	delete(db.contacts, source.Id)
+	return merged, nil
+}
+
+func (db *MockDatastore) RetrieveContactsBy(param string, value string) []Contact {
+	result := []Contact{}
+	for _, c := range db.contacts {
+		if param == "id" && c.Id.Hex() == value || param == "name" && c.Name == value || param == "email" && c.Email == value {
+			result = append(result, c)
+		}
+		if strings.HasPrefix(param, "fields.") {
+			stored := c.Fields[strings.TrimPrefix(param, "fields.")]
+			for _, v := range fieldQueryValues(value) {
+				if reflect.DeepEqual(stored, v) {
+					result = append(result, c)
+					break
+				}
+			}
+		}
+		if param == "tag" {
+			for _, tag := range c.Tags {
+				if tag == value {
+					result = append(result, c)
+					break
+				}
+			}
+		}
+	}
+	return result
+}
+
+func (db *MockDatastore) DeleteContact(id string) bool {
+	oid := bson.ObjectIdHex(id)
+	if _, ok := db.contacts[oid]; !ok {
+		return false
+	}
+	delete(db.contacts, oid)
+	return true
+}
+
+func (db *MockDatastore) StoreSuppression(suppression Suppression) (Suppression, error) {
+	if err := normalizeSuppression(&suppression); err != nil {
+		return Suppression{}, err
+	}
+	db.suppressions[suppression.Email] = suppression
+	return suppression, nil
+}
+
+func (db *MockDatastore) RetrieveSuppressions() []Suppression {
+	result := []Suppression{}
+	for _, s := range db.suppressions {
+		result = append(result, s)
+	}
+	return result
+}
+
+func (db *MockDatastore) RetrieveSuppression(email string) (Suppression, error) {
+	suppression, ok := db.suppressions[email]
+	if !ok {
+		return Suppression{}, ErrSuppressionNotFound
+	}
+	return suppression, nil
+}
+
+func (db *MockDatastore) IsSuppressed(email string) (bool, error) {
+	if db.closed {
+		return false, ErrDatastoreClosed
+	}
+	_, ok := db.suppressions[email]
+	return ok, nil
+}
+
+func (db *MockDatastore) DeleteSuppression(email string) bool {
+	if _, ok := db.suppressions[email]; !ok {
+		return false
+	}
+	delete(db.suppressions, email)
+	return true
+}
+
+func (db *MockDatastore) StoreAPIKey(key APIKey) (APIKey, error) {
+	db.apiKeys[key.Id.Hex()] = key
+	return key, nil
+}
+
+func (db *MockDatastore) RetrieveAPIKey(id string) (APIKey, error) {
+	key, ok := db.apiKeys[id]
+	if !ok {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return key, nil
+}
+
+func (db *MockDatastore) RetrieveAPIKeys() []APIKey {
+	result := []APIKey{}
+	for _, key := range db.apiKeys {
+		result = append(result, key)
+	}
+	return result
+}
+
+func (db *MockDatastore) RevokeAPIKey(id string) bool {
+	key, ok := db.apiKeys[id]
+	if !ok {
+		return false
+	}
+	key.Revoked = true
+	db.apiKeys[id] = key
+	return true
+}
+
+func (db *MockDatastore) StoreUser(user User) (User, error) {
+	if err := normalizeUser(&user); err != nil {
+		return User{}, err
+	}
+	if _, err := db.RetrieveUser(user.Username); err == nil {
+		return User{}, ErrDuplicateUser
+	}
+	db.users[user.Id] = user
+	return user, nil
+}
+
+func (db *MockDatastore) RetrieveUser(username string) (User, error) {
+	for _, user := range db.users {
+		if user.Username == strings.ToLower(username) {
+			return user, nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+func (db *MockDatastore) RetrieveUserById(id string) (User, error) {
+	user, ok := db.users[bson.ObjectIdHex(id)]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (db *MockDatastore) RetrieveUserBySubject(issuer string, subject string) (User, error) {
+	for _, user := range db.users {
+		if len(subject) > 0 && user.Issuer == issuer && user.Subject == subject {
+			return user, nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+func (db *MockDatastore) UpdateUser(user User) error {
+	if err := normalizeUser(&user); err != nil {
+		return err
+	}
+	if _, ok := db.users[user.Id]; !ok {
+		return ErrUserNotFound
+	}
+	db.users[user.Id] = user
+	return nil
+}
+
+func (db *MockDatastore) RetrieveUsers() []User {
+	result := []User{}
+	for _, user := range db.users {
+		result = append(result, user)
+	}
+	return result
+}
+
+func (db *MockDatastore) DeleteUser(id string) bool {
+	if _, ok := db.users[bson.ObjectIdHex(id)]; !ok {
+		return false
+	}
+	delete(db.users, bson.ObjectIdHex(id))
+	return true
+}
+
+func (db *MockDatastore) StoreSession(session Session) error {
+	db.sessions[session.Id] = session
+	return nil
+}
+
+func (db *MockDatastore) RetrieveSession(id string) (Session, error) {
+	session, ok := db.sessions[id]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (db *MockDatastore) DeleteSession(id string) bool {
+	if _, ok := db.sessions[id]; !ok {
+		return false
+	}
+	delete(db.sessions, id)
+	return true
+}
+
+func (db *MockDatastore) StoreSendRecord(record SendRecord) error {
+	db.history = append(db.history, record)
+	return nil
+}
+
+func (db *MockDatastore) RetrieveSendRecords(userId string) []SendRecord {
+	result := []SendRecord{}
+	for _, record := range db.history {
+		if record.UserId.Hex() == userId {
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+func (db *MockDatastore) IncrementProviderUsage(name string, day string) error {
+	db.usage[name+":"+day]++
+	return nil
+}
+
+func (db *MockDatastore) StoreProviderOverride(override ProviderOverride) error {
+	db.overrides[override.Name] = override
+	return nil
+}
+
+func (db *MockDatastore) RetrieveProviderOverrides() []ProviderOverride {
+	result := []ProviderOverride{}
+	for _, override := range db.overrides {
+		result = append(result, override)
+	}
+	return result
+}
+
+func (db *MockDatastore) RetrieveProviderUsage(day string) map[string]int {
+	result := make(map[string]int)
+	for key, count := range db.usage {
+		if strings.HasSuffix(key, ":"+day) {
+			result[strings.TrimSuffix(key, ":"+day)] = count
+		}
+	}
+	return result
+}
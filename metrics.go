@@ -0,0 +1,207 @@
+// Prometheus metrics in the text exposition format
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric which can write itself in the exposition format
+type metric interface {
+	write(io.Writer)
+}
+
+var metricsRegistry []metric
+
+// Counter, gauge or histogram family keyed by label values
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	values map[string]float64
+	counts map[string][]uint64
+	sums   map[string]float64
+}
+
+func newMetricVec(kind string, name string, help string, buckets []float64, labels ...string) *metricVec {
+	m := &metricVec{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]float64),
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+	}
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+func newCounter(name string, help string, labels ...string) *metricVec {
+	return newMetricVec("counter", name, help, nil, labels...)
+}
+
+func newGauge(name string, help string, labels ...string) *metricVec {
+	return newMetricVec("gauge", name, help, nil, labels...)
+}
+
+func newHistogram(name string, help string, buckets []float64, labels ...string) *metricVec {
+	return newMetricVec("histogram", name, help, buckets, labels...)
+}
+
+// Default latency buckets in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	messagesAccepted = newCounter("maelstrom_messages_accepted_total",
+		"Messages accepted for sending.")
+	messagesSent = newCounter("maelstrom_messages_sent_total",
+		"Messages sent successfully by provider and response status.", "provider", "status")
+	messagesFailed = newCounter("maelstrom_messages_failed_total",
+		"Messages a provider failed to send by provider and response status.", "provider", "status")
+	sendLatency = newHistogram("maelstrom_send_duration_seconds",
+		"Time taken by a provider to send a message.", latencyBuckets, "provider")
+	providerUp = newGauge("maelstrom_provider_up",
+		"Whether the provider answered its last ping.", "provider")
+	throttleRejections = newCounter("maelstrom_throttle_rejections_total",
+		"Sends refused by rate limits by limit.", "limit")
+	contactOperations = newCounter("maelstrom_contact_operations_total",
+		"Contact API operations by operation and response status.", "operation", "status")
+	datastoreLatency = newHistogram("maelstrom_datastore_duration_seconds",
+		"Time taken by Datastore operations.", latencyBuckets, "operation")
+	configReloads = newCounter("maelstrom_config_reloads_total",
+		"Config reloads by result, applied or rejected.", "result")
+)
+
+func (m *metricVec) key(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *metricVec) Add(value float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[m.key(labelValues)] += value
+}
+
+func (m *metricVec) Set(value float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[m.key(labelValues)] = value
+}
+
+func (m *metricVec) Observe(value float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := m.key(labelValues)
+	counts, ok := m.counts[key]
+	if !ok {
+		counts = make([]uint64, len(m.buckets))
+		m.counts[key] = counts
+	}
+	for i, bound := range m.buckets {
+		if value <= bound {
+			counts[i]++
+		}
+	}
+	m.sums[key] += value
+	m.values[key]++
+}
+
+// Observe the seconds elapsed since start
+func (m *metricVec) Since(start time.Time, labelValues ...string) {
+	m.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// Record the duration of a Datastore operation, use with defer
+func observeDatastore(operation string, start time.Time) {
+	datastoreLatency.Since(start, operation)
+}
+
+// Format label pairs, with an optional extra pair such as le="0.5"
+func (m *metricVec) labelString(key string, extra ...string) string {
+	pairs := []string{}
+	if len(m.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, m.labels[i]+`="`+escapeLabel(value)+`"`)
+		}
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+`="`+extra[1]+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	keys := []string{}
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 && len(m.labels) == 0 && m.kind != "histogram" {
+		fmt.Fprintf(w, "%s 0\n", m.name)
+	}
+	for _, key := range keys {
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labelString(key), formatFloat(m.values[key]))
+			continue
+		}
+		for i, bound := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelString(key, "le", formatFloat(bound)), m.counts[key][i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %s\n", m.name, m.labelString(key, "le", "+Inf"), formatFloat(m.values[key]))
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labelString(key), formatFloat(m.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %s\n", m.name, m.labelString(key), formatFloat(m.values[key]))
+	}
+}
+
+// ResponseWriter recording the status code written
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.wroteHeader = true
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	fmt.Println("Running Test: TestMetricsExposition")
+
+	// Setup
+	counter := &metricVec{name: "test_total", help: "Test.", kind: "counter", labels: []string{"name"}, values: map[string]float64{}}
+	counter.Inc(`a "quoted"` + "\nvalue")
+	histogram := &metricVec{name: "test_seconds", help: "Test.", kind: "histogram", buckets: []float64{0.1, 1}, labels: []string{"op"},
+		values: map[string]float64{}, counts: map[string][]uint64{}, sums: map[string]float64{}}
+	histogram.Observe(0.5, "read")
+	histogram.Observe(2, "read")
+
+	var buff bytes.Buffer
+	counter.write(&buff)
+	histogram.write(&buff)
+	expected := []string{
+		"# TYPE test_total counter",
+		`test_total{name="a \"quoted\"\nvalue"} 1`,
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{op="read",le="0.1"} 0`,
+		`test_seconds_bucket{op="read",le="1"} 1`,
+		`test_seconds_bucket{op="read",le="+Inf"} 2`,
+		`test_seconds_sum{op="read"} 2.5`,
+		`test_seconds_count{op="read"} 2`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(buff.String(), line+"\n") {
+			t.Errorf("Missing line %s in:\n%s", line, buff.String())
+		}
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestMetricsHandler(t *testing.T) {
+	fmt.Println("Running Test: TestMetricsHandler")
+
+	// Setup
+	datastore = NewMockDatastore()
+	Servers = map[MailSender]bool{&MockServer{}: true}
+	config = Config{EmailThrottle: 5}
+	initRateLimits()
+	initProviderLimits()
+	handler := buildTestHandler()
+	key := buildTestKey(ScopeSend, ScopeContactsWrite)
+
+	doAuthRequest(handler, "POST", "/messages/", `{"to":["a@example.com"],"from":"me@example.com","subject":"Hi","text":"Hi"}`, key)
+	doAuthRequest(handler, "POST", "/contacts/", `{"email":"bad"}`, key)
+
+	res := doRequest(handler, "GET", "/metrics", "")
+	if res.Code != 401 {
+		t.Errorf("Unauthenticated GET /metrics returned %d should be 401.", res.Code)
+	}
+	res = doAuthRequest(handler, "GET", "/metrics", "", key)
+	body := res.Body.String()
+	for _, line := range []string{
+		`maelstrom_messages_sent_total{provider="MockServer",status="200"}`,
+		`maelstrom_send_duration_seconds_count{provider="MockServer"}`,
+		`maelstrom_contact_operations_total{operation="create",status="400"}`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Missing metric %s", line)
+		}
+	}
+	if !strings.HasPrefix(res.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected Content-Type %s", res.Header().Get("Content-Type"))
+	}
+
+	fmt.Println("Test Complete.")
+}
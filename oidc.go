@@ -0,0 +1,432 @@
+// OpenID Connect sign-in (authorization code flow with PKCE)
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const oidcCookie = "maelstrom_oidc"
+
+// Settings for signing in through an OpenID Connect issuer
+type OIDCConfig struct {
+	Name          string
+	Issuer        string
+	ClientId      string
+	ClientSecret  string
+	RedirectUrl   string
+	Scopes        []string
+	UsernameClaim string
+	RoleClaim     string
+	RoleMapping   map[string][]string
+	DefaultRoles  []string
+}
+
+// Issuer metadata from /.well-known/openid-configuration
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var oidcLock sync.Mutex
+var oidcDiscovered *oidcProvider
+var oidcKeys map[string]crypto.PublicKey
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+func oidcConfig() OIDCConfig {
+	return currentConfig().OIDC
+}
+
+// Forget the discovered issuer, after its configuration changed
+func resetOIDC() {
+	oidcLock.Lock()
+	oidcDiscovered = nil
+	oidcKeys = nil
+	oidcLock.Unlock()
+}
+
+func oidcEnabled() bool {
+	return len(oidcConfig().Issuer) > 0 && len(oidcConfig().ClientId) > 0
+}
+
+// Display name of the issuer for the login page, empty when disabled
+func oidcName() string {
+	if !oidcEnabled() {
+		return ""
+	}
+	if len(oidcConfig().Name) > 0 {
+		return oidcConfig().Name
+	}
+	return oidcConfig().Issuer
+}
+
+// Fetch and cache the issuer metadata
+func discoverOIDC() (*oidcProvider, error) {
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+	if oidcDiscovered != nil {
+		return oidcDiscovered, nil
+	}
+
+	issuer := strings.TrimRight(oidcConfig().Issuer, "/")
+	provider := &oidcProvider{}
+	if err := getJson(issuer+"/.well-known/openid-configuration", provider); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(provider.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("issuer mismatch: %s", provider.Issuer)
+	}
+	oidcDiscovered = provider
+	return provider, nil
+}
+
+// Look up an issuer signing key, refetching the JWKS for unknown key ids
+func oidcKey(provider *oidcProvider, kid string) (crypto.PublicKey, error) {
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+	if key, ok := oidcKeys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJson(provider.JwksUri, &jwks); err != nil {
+		return nil, err
+	}
+	oidcKeys = make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			Log.Warn("Skipping unsupported JWK", "error", err)
+			continue
+		}
+		oidcKeys[jwk.Kid] = key
+	}
+	if key, ok := oidcKeys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key: %s", kid)
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+func getJson(url string, v interface{}) error {
+	res, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("GET %s returned %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// PKCE S256 challenge for a verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Build the authorization request, returning the URL and the state, nonce
+// and PKCE verifier to remember until the callback
+func oidcAuthorizationUrl(provider *oidcProvider) (string, string) {
+	state := randomToken()
+	nonce := randomToken()
+	verifier := randomToken()
+
+	scopes := oidcConfig().Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	values := url.Values{}
+	values.Set("response_type", "code")
+	values.Set("client_id", oidcConfig().ClientId)
+	values.Set("redirect_uri", oidcConfig().RedirectUrl)
+	values.Set("scope", strings.Join(scopes, " "))
+	values.Set("state", state)
+	values.Set("nonce", nonce)
+	values.Set("code_challenge", pkceChallenge(verifier))
+	values.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.AuthorizationEndpoint + separator + values.Encode(), state + "." + nonce + "." + verifier
+}
+
+// Exchange the authorization code and return the verified ID token claims
+func oidcExchange(provider *oidcProvider, code string, verifier string, nonce string) (map[string]interface{}, error) {
+	values := url.Values{}
+	values.Set("grant_type", "authorization_code")
+	values.Set("code", code)
+	values.Set("redirect_uri", oidcConfig().RedirectUrl)
+	values.Set("client_id", oidcConfig().ClientId)
+	values.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest("POST", provider.TokenEndpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(oidcConfig().ClientSecret) > 0 {
+		req.SetBasicAuth(url.QueryEscape(oidcConfig().ClientId), url.QueryEscape(oidcConfig().ClientSecret))
+	}
+	res, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("token endpoint returned %s", res.Status)
+	}
+	var token struct {
+		IdToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+
+	claims, err := verifyIdToken(provider, token.IdToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	return claims, nil
+}
+
+// Verify the ID token signature, issuer, audience and expiry
+func verifyIdToken(provider *oidcProvider, idToken string) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	key, err := oidcKey(provider, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errors.New("invalid id token signature")
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return nil, errors.New("invalid id token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return nil, errors.New("invalid id token signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported id token algorithm %s", header.Alg)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims["iss"] != provider.Issuer {
+		return nil, errors.New("id token issuer mismatch")
+	}
+	if !audienceContains(claims["aud"], oidcConfig().ClientId) {
+		return nil, errors.New("id token audience mismatch")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || time.Now().After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("id token expired")
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func audienceContains(aud interface{}, clientId string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientId
+	case []interface{}:
+		for _, v := range a {
+			if v == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Local roles for the identity claims. Roles from RoleMapping are used when
+// the role claim matches any entry, otherwise DefaultRoles
+func oidcRoles(claims map[string]interface{}) []string {
+	values := []string{}
+	switch claim := claims[oidcConfig().RoleClaim].(type) {
+	case string:
+		values = append(values, claim)
+	case []interface{}:
+		for _, v := range claim {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	roles := []string{}
+	for _, value := range values {
+		for _, role := range oidcConfig().RoleMapping[value] {
+			if !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+	}
+	if len(roles) == 0 {
+		return oidcConfig().DefaultRoles
+	}
+	return roles
+}
+
+// Find or create the local User for the identity claims, keeping roles in
+// sync with the issuer. Users are linked by issuer and subject, never to a
+// password account that happens to have the same username
+func oidcUser(store Datastore, claims map[string]interface{}) (User, error) {
+	issuer, _ := claims["iss"].(string)
+	subject, _ := claims["sub"].(string)
+	if len(subject) == 0 {
+		return User{}, errors.New("missing sub claim")
+	}
+	roles := oidcRoles(claims)
+	user, err := store.RetrieveUserBySubject(issuer, subject)
+	if err == nil {
+		return syncOIDCRoles(store, user, roles)
+	}
+	if err != ErrUserNotFound {
+		return User{}, err
+	}
+
+	usernameClaim := oidcConfig().UsernameClaim
+	if len(usernameClaim) == 0 {
+		usernameClaim = "email"
+	}
+	username, _ := claims[usernameClaim].(string)
+	if len(username) == 0 {
+		return User{}, fmt.Errorf("missing %s claim", usernameClaim)
+	}
+	if verified, _ := claims["email_verified"].(bool); usernameClaim == "email" && !verified {
+		return User{}, errors.New("email not verified")
+	}
+
+	user, err = store.RetrieveUser(username)
+	if err == ErrUserNotFound {
+		return store.StoreUser(User{
+			Id:       bson.NewObjectId(),
+			Username: username,
+			Roles:    roles,
+			Created:  time.Now().UTC(),
+			Issuer:   issuer,
+			Subject:  subject,
+		})
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	// Users signed in before subjects were recorded have no password and
+	// are linked on their next sign-in, any other is someone else's
+	if len(user.PasswordHash) > 0 || len(user.Subject) > 0 {
+		return User{}, fmt.Errorf("username %s belongs to another account", username)
+	}
+	user.Issuer, user.Subject = issuer, subject
+	return syncOIDCRoles(store, user, roles)
+}
+
+// Store roles from the issuer on user, unless roles are managed locally
+func syncOIDCRoles(store Datastore, user User, roles []string) (User, error) {
+	if len(oidcConfig().RoleClaim) > 0 {
+		user.Roles = roles
+	}
+	return user, store.UpdateUser(user)
+}
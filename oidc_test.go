@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOIDCSignIn(t *testing.T) {
+	fmt.Println("Running Test: TestOIDCSignIn")
+
+	// Setup
+	datastore = NewMockDatastore()
+	handler := buildTestHandler()
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+	config = Config{OIDC: OIDCConfig{
+		Issuer:       issuer.URL,
+		ClientId:     "maelstrom",
+		RedirectUrl:  "http://localhost/login/oidc/callback",
+		RoleClaim:    "groups",
+		RoleMapping:  map[string][]string{"mail-admins": {RoleAdmin}},
+		DefaultRoles: []string{RoleSender},
+	}}
+	oidcDiscovered = nil
+	oidcKeys = nil
+
+	res := doRequest(handler, "GET", "/login/oidc", "")
+	if res.Code != 302 {
+		t.Fatalf("OIDC login returned %d should be 302.", res.Code)
+	}
+	authUrl, _ := url.Parse(res.Header().Get("Location"))
+	params := authUrl.Query()
+	if params.Get("code_challenge_method") != "S256" || len(params.Get("code_challenge")) == 0 {
+		t.Errorf("Authorization request should use PKCE: %s", authUrl)
+	}
+	issuer.challenge = params.Get("code_challenge")
+	issuer.nonce = params.Get("nonce")
+	pending := findCookie(res, oidcCookie)
+
+	// Tampered state
+	req := httptest.NewRequest("GET", "/login/oidc/callback?code=code&state=wrong", nil)
+	req.AddCookie(pending)
+	res = httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != 400 {
+		t.Errorf("Callback with wrong state returned %d should be 400.", res.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/login/oidc/callback?code=code&state="+params.Get("state"), nil)
+	req.AddCookie(pending)
+	res = httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != 303 || findCookie(res, sessionCookie) == nil {
+		t.Fatalf("Callback returned %d should be 303 with a session.", res.Code)
+	}
+
+	user, err := datastore.RetrieveUser("carol@example.com")
+	if err != nil || len(user.Roles) != 1 || user.Roles[0] != RoleAdmin {
+		t.Errorf("Unexpected user from claims %+v", user)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestOIDCUserLinking(t *testing.T) {
+	fmt.Println("Running Test: TestOIDCUserLinking")
+
+	// Setup
+	datastore = NewMockDatastore()
+	config = Config{OIDC: OIDCConfig{Issuer: "https://idp.example.com", DefaultRoles: []string{RoleSender}}}
+	hash, _ := hashPassword("password1")
+	admin, _ := datastore.StoreUser(User{Id: bson.NewObjectId(), Username: "alice@example.com", PasswordHash: hash, Roles: []string{RoleAdmin}})
+	legacy, _ := datastore.StoreUser(User{Id: bson.NewObjectId(), Username: "bob@example.com", Roles: []string{RoleSender}})
+	claims := func(subject string, email string, verified interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": "https://idp.example.com", "sub": subject, "email": email}
+		if verified != nil {
+			c["email_verified"] = verified
+		}
+		return c
+	}
+
+	// A password account is never taken over by a matching email
+	if user, err := oidcUser(datastore, claims("mallory", "Alice@example.com", true)); err == nil {
+		t.Errorf("IdP identity signed in as local user %+v", user)
+	}
+	if user, _ := datastore.RetrieveUser("alice@example.com"); user.Id != admin.Id || len(user.Subject) > 0 {
+		t.Errorf("Local user changed to %+v", user)
+	}
+
+	// Email must be verified, not just unrefuted
+	for _, verified := range []interface{}{nil, false, "true"} {
+		if _, err := oidcUser(datastore, claims("carol", "carol@example.com", verified)); err == nil {
+			t.Errorf("Signed in with email_verified %v", verified)
+		}
+	}
+
+	// Users from before subjects were recorded are linked once
+	user, err := oidcUser(datastore, claims("bob", "bob@example.com", true))
+	if err != nil || user.Id != legacy.Id || user.Subject != "bob" {
+		t.Errorf("Legacy user not linked: %+v %v", user, err)
+	}
+	if _, err := oidcUser(datastore, claims("bob-2", "bob@example.com", true)); err == nil {
+		t.Errorf("Second subject linked to a linked user")
+	}
+
+	// Later sign-ins find the user by subject whatever the email
+	user, err = oidcUser(datastore, claims("bob", "robert@example.com", false))
+	if err != nil || user.Id != legacy.Id {
+		t.Errorf("Linked user not found by subject: %+v %v", user, err)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestVerifyIdToken(t *testing.T) {
+	fmt.Println("Running Test: TestVerifyIdToken")
+
+	// Setup
+	issuer := newFakeIssuer(t)
+	defer issuer.Close()
+	config = Config{OIDC: OIDCConfig{Issuer: issuer.URL, ClientId: "maelstrom"}}
+	oidcDiscovered = nil
+	oidcKeys = nil
+	provider, err := discoverOIDC()
+	if err != nil {
+		t.Fatalf("discoverOIDC returned error %s", err)
+	}
+
+	valid := issuer.sign(map[string]interface{}{"iss": issuer.URL, "aud": "maelstrom", "exp": time.Now().Add(time.Minute).Unix()})
+	if _, err := verifyIdToken(provider, valid); err != nil {
+		t.Errorf("Valid token rejected: %s", err)
+	}
+	wrongAud := issuer.sign(map[string]interface{}{"iss": issuer.URL, "aud": "other", "exp": time.Now().Add(time.Minute).Unix()})
+	if _, err := verifyIdToken(provider, wrongAud); err == nil {
+		t.Errorf("Token for another audience accepted.")
+	}
+	expired := issuer.sign(map[string]interface{}{"iss": issuer.URL, "aud": "maelstrom", "exp": time.Now().Add(-time.Minute).Unix()})
+	if _, err := verifyIdToken(provider, expired); err == nil {
+		t.Errorf("Expired token accepted.")
+	}
+	tampered := valid[:len(valid)-4] + "AAAA"
+	if _, err := verifyIdToken(provider, tampered); err == nil {
+		t.Errorf("Tampered token accepted.")
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+// Mocks
+
+// Minimal OpenID Connect issuer serving discovery, JWKS and token endpoints
+type fakeIssuer struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &fakeIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.URL,
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+			"jwks_uri":               issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		if pkceChallenge(req.FormValue("code_verifier")) != issuer.challenge || req.FormValue("code") != "code" {
+			w.WriteHeader(400)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": issuer.sign(map[string]interface{}{
+			"iss":            issuer.URL,
+			"aud":            "maelstrom",
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"nonce":          issuer.nonce,
+			"sub":            "carol-1",
+			"email":          "Carol@example.com",
+			"email_verified": true,
+			"groups":         []string{"staff", "mail-admins"},
+		})})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	return issuer
+}
+
+func (issuer *fakeIssuer) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, issuer.key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
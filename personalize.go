@@ -0,0 +1,78 @@
+// Message personalization using contact details and custom fields
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+)
+
+var personalizeFuncs = template.FuncMap{
+	"default": templateDefault,
+}
+
+// Variables available when rendering a message for a recipient,
+// e.g. {{.Name}} or {{.Fields.company | default "there"}}
+type templateVars struct {
+	Email  string
+	Name   string
+	Tags   []string
+	Fields ContactFields
+}
+
+// Render Subject and Text separately for each recipient when the message
+// uses template actions. Messages without templates are returned as is
+func personalizeMessage(store Datastore, message Message) ([]Message, error) {
+	if !strings.Contains(message.Subject, "{{") && !strings.Contains(message.Text, "{{") {
+		return []Message{message}, nil
+	}
+
+	subject, err := template.New("subject").Funcs(personalizeFuncs).Parse(message.Subject)
+	if err != nil {
+		return nil, err
+	}
+	text, err := template.New("text").Funcs(personalizeFuncs).Parse(message.Text)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, 0, len(message.To))
+	for _, to := range message.To {
+		vars := templateVars{Email: to, Fields: ContactFields{}}
+		contacts := store.RetrieveContactsBy("email", strings.ToLower(strings.TrimSpace(to)))
+		if len(contacts) > 0 {
+			vars.Name = contacts[0].Name
+			vars.Tags = contacts[0].Tags
+			if contacts[0].Fields != nil {
+				vars.Fields = contacts[0].Fields
+			}
+		}
+
+		personal := message
+		personal.To = []string{to}
+		var buff bytes.Buffer
+		if err := subject.Execute(&buff, vars); err != nil {
+			return nil, err
+		}
+		personal.Subject = buff.String()
+		buff.Reset()
+		if err := text.Execute(&buff, vars); err != nil {
+			return nil, err
+		}
+		personal.Text = buff.String()
+		messages = append(messages, personal)
+	}
+	return messages, nil
+}
+
+// Template function returning def when value is missing or empty
+func templateDefault(def string, value interface{}) interface{} {
+	if value == nil {
+		return def
+	}
+	if s, ok := value.(string); ok && len(s) == 0 {
+		return def
+	}
+	return value
+}
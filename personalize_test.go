@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPersonalizeMessage(t *testing.T) {
+	fmt.Println("Running Test: TestPersonalizeMessage")
+
+	// Setup
+	datastore = NewMockDatastore()
+	datastore.StoreContact(Contact{Email: "a@example.com", Name: "Alice", Fields: ContactFields{"company": "Acme"}})
+
+	message := Message{
+		To:      []string{"a@example.com", "b@example.com"},
+		Subject: "Hi {{.Name | default \"there\"}}",
+		Text:    "Welcome from {{.Fields.company | default \"us\"}}",
+	}
+	messages, err := personalizeMessage(datastore, message)
+	if err != nil {
+		t.Fatalf("personalizeMessage returned error %s", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("personalizeMessage returned %d messages should be 2.", len(messages))
+	}
+	if messages[0].Subject != "Hi Alice" || messages[0].Text != "Welcome from Acme" {
+		t.Errorf("Unexpected message for contact: %+v", messages[0])
+	}
+	if messages[1].Subject != "Hi there" || messages[1].Text != "Welcome from us" {
+		t.Errorf("Unexpected message for unknown recipient: %+v", messages[1])
+	}
+
+	fmt.Println("Test Complete.")
+}
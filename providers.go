@@ -0,0 +1,189 @@
+// Manual Mail Server overrides set by admins at runtime
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Override modes. Auto follows checkServers, enabled keeps a Mail Server
+// in rotation whatever its pings say, disabled takes it out and draining
+// stops new sends while those in flight finish
+const (
+	ProviderAuto     = "auto"
+	ProviderEnabled  = "enabled"
+	ProviderDisabled = "disabled"
+	ProviderDraining = "draining"
+)
+
+var overridesLock sync.RWMutex
+var providerOverrides = make(map[string]ProviderOverride)
+
+var inFlightLock sync.Mutex
+var inFlightSends = make(map[string]int)
+
+var ErrNoProviderKeySecret = errors.New("no providerKeySecret configured")
+
+// Load the overrides saved before a restart
+func loadProviderOverrides() {
+	overrides := make(map[string]ProviderOverride)
+	for _, override := range datastore.RetrieveProviderOverrides() {
+		if len(override.SealedKey) > 0 {
+			apiKey, err := openProviderKey(override.Name, override.SealedKey)
+			if err != nil {
+				Log.Warn("Could not decrypt stored apiKey, using the config's", "provider", override.Name, "error", err)
+			}
+			override.ApiKey = apiKey
+		}
+		overrides[override.Name] = override
+	}
+	overridesLock.Lock()
+	providerOverrides = overrides
+	overridesLock.Unlock()
+}
+
+// Save and apply an override. Only the sealed apiKey is stored
+func setProviderOverride(override ProviderOverride) error {
+	override.Updated = time.Now()
+	stored := override
+	stored.ApiKey = ""
+	err := datastore.StoreProviderOverride(stored)
+	if err != nil {
+		return err
+	}
+	overridesLock.Lock()
+	providerOverrides[override.Name] = override
+	overridesLock.Unlock()
+	return nil
+}
+
+func providerOverride(name string) ProviderOverride {
+	overridesLock.RLock()
+	defer overridesLock.RUnlock()
+	override, ok := providerOverrides[name]
+	if !ok {
+		override = ProviderOverride{Name: name}
+	}
+	if len(override.Mode) == 0 {
+		override.Mode = ProviderAuto
+	}
+	return override
+}
+
+// Cipher for apiKeys set through PUT /providers, keyed by the configured
+// providerKeySecret
+func providerKeyCipher() (cipher.AEAD, error) {
+	secret := currentConfig().ProviderKeySecret
+	if len(secret) == 0 {
+		return nil, ErrNoProviderKeySecret
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt a Mail Server's apiKey for storing, bound to the server's name
+func sealProviderKey(name string, apiKey string) (string, error) {
+	aead, err := providerKeyCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(apiKey), []byte(name))), nil
+}
+
+func openProviderKey(name string, sealed string) (string, error) {
+	aead, err := providerKeyCipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < aead.NonceSize() {
+		return "", errors.New("sealed apiKey too short")
+	}
+	apiKey, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return "", err
+	}
+	return string(apiKey), nil
+}
+
+// The configured Mail Servers with any url and apiKey set through
+// PUT /providers, so those changes survive reloads and restarts
+func mailServerConfigs() []MailServer {
+	servers := append([]MailServer{}, currentConfig().MailServers...)
+	for i := range servers {
+		override := providerOverride(servers[i].Name)
+		if len(override.Url) > 0 {
+			servers[i].Url = override.Url
+		}
+		if len(override.ApiKey) > 0 {
+			servers[i].ApiKey = override.ApiKey
+		}
+	}
+	return servers
+}
+
+// Whether new sends may go to the Mail Server, the override taking
+// precedence over its last ping
+func providerSelectable(name string, up bool) bool {
+	switch providerOverride(name).Mode {
+	case ProviderEnabled:
+		return true
+	case ProviderDisabled, ProviderDraining:
+		return false
+	}
+	return up
+}
+
+func beginSend(name string) {
+	inFlightLock.Lock()
+	inFlightSends[name]++
+	inFlightLock.Unlock()
+}
+
+func endSend(name string) {
+	inFlightLock.Lock()
+	inFlightSends[name]--
+	inFlightLock.Unlock()
+}
+
+func sendsInFlight(name string) int {
+	inFlightLock.Lock()
+	defer inFlightLock.Unlock()
+	return inFlightSends[name]
+}
+
+// Ping a Mail Server now rather than waiting for the pinger. Returns
+// false if no such server is configured
+func pingProvider(name string) (bool, bool) {
+	serversLock.RLock()
+	servers := Servers
+	serversLock.RUnlock()
+	for server := range serverStatusesOf(servers) {
+		if server.GetName() == name {
+			start := time.Now()
+			status := server.Ping()
+			recordPing(name, status, time.Since(start))
+			setServerStatus(servers, server, status)
+			return status, true
+		}
+	}
+	return false, false
+}
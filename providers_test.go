@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestProviderOverrides(t *testing.T) {
+	fmt.Println("Running Test: TestProviderOverrides")
+
+	// Setup
+	datastore = NewMockDatastore()
+	loadProviderOverrides()
+	config = Config{EmailThrottle: 5, MailServers: []MailServer{{Name: "MockServer"}}}
+	mock := &MockServer{}
+	Servers = map[MailSender]bool{mock: true}
+	initRateLimits()
+	initProviderLimits()
+	handler := buildTestHandler()
+	admin := buildTestKey(ScopeAdmin)
+	sender := buildTestKey(ScopeSend)
+	message := `{"to":["a@example.com"],"from":"me@example.com","subject":"Hi","text":"Hi"}`
+
+	res := doAuthRequest(handler, "POST", "/providers/MockServer/disable", "", sender)
+	if res.Code != 403 {
+		t.Errorf("Non admin disable returned %d should be 403.", res.Code)
+	}
+	res = doAuthRequest(handler, "POST", "/providers/Unknown/disable", "", admin)
+	if res.Code != 404 {
+		t.Errorf("Disabling unknown provider returned %d should be 404.", res.Code)
+	}
+
+	res = doAuthRequest(handler, "POST", "/providers/MockServer/disable", `{"reason":"vendor incident"}`, admin)
+	if res.Code != 200 || !strings.Contains(res.Body.String(), `"mode":"disabled"`) {
+		t.Errorf("Disable returned %d %s", res.Code, res.Body.String())
+	}
+	if chooseMailSender(context.Background(), 1) != nil {
+		t.Errorf("Disabled provider still chosen")
+	}
+	res = doAuthRequest(handler, "POST", "/messages/", message, sender)
+	if res.Code != 500 {
+		t.Errorf("Send with provider disabled returned %d should be 500.", res.Code)
+	}
+
+	// Survives a restart
+	providerOverrides = make(map[string]ProviderOverride)
+	loadProviderOverrides()
+	if override := providerOverride("MockServer"); override.Mode != ProviderDisabled || override.Reason != "vendor incident" {
+		t.Errorf("Override not reloaded, got %+v", override)
+	}
+
+	// Enabled wins over a failed ping
+	doAuthRequest(handler, "POST", "/providers/MockServer/enable", "", admin)
+	setServerStatus(Servers, mock, false)
+	if chooseMailSender(context.Background(), 1) == nil {
+		t.Errorf("Enabled provider not chosen while down")
+	}
+
+	doAuthRequest(handler, "POST", "/providers/MockServer/drain", "", admin)
+	if chooseMailSender(context.Background(), 1) != nil {
+		t.Errorf("Draining provider still chosen")
+	}
+
+	// Back to following pings, forcing one now
+	doAuthRequest(handler, "POST", "/providers/MockServer/auto", "", admin)
+	res = doAuthRequest(handler, "POST", "/providers/MockServer/ping", "", admin)
+	if res.Code != 200 || !strings.Contains(res.Body.String(), `"up":true`) || !strings.Contains(res.Body.String(), `"mode":"auto"`) {
+		t.Errorf("Ping returned %d %s", res.Code, res.Body.String())
+	}
+	if chooseMailSender(context.Background(), 1) == nil {
+		t.Errorf("Provider not chosen after returning to auto")
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestUpdateProvider(t *testing.T) {
+	fmt.Println("Running Test: TestUpdateProvider")
+
+	// Setup
+	datastore = NewMockDatastore()
+	loadProviderOverrides()
+	config = Config{EmailThrottle: 5, MailServers: []MailServer{{Name: "MailGun", Url: "http://127.0.0.1:1/", ApiKey: "old"}}}
+	handler := buildTestHandler()
+	admin := buildTestKey(ScopeAdmin)
+
+	for _, reference := range []string{"env:HOME", "file:/etc/passwd", "vault:secret/data/maelstrom#key", "gce:emailPW"} {
+		res := doAuthRequest(handler, "PUT", "/v1/providers/MailGun", `{"url":"https://attacker.example.com","apiKey":"`+reference+`"}`, admin)
+		if res.Code != 400 {
+			t.Errorf("Update with apiKey %s returned %d should be 400.", reference, res.Code)
+		}
+	}
+	if server := mailServerConfigs()[0]; server.ApiKey != "old" || server.Url != "http://127.0.0.1:1/" {
+		t.Errorf("Rejected update changed the Mail Server: %+v", server)
+	}
+
+	// Keys are only stored encrypted
+	res := doAuthRequest(handler, "PUT", "/v1/providers/MailGun", `{"apiKey":"key-1"}`, admin)
+	if res.Code != 400 || mailServerConfigs()[0].ApiKey != "old" {
+		t.Errorf("Update without providerKeySecret returned %d, apiKey %s", res.Code, mailServerConfigs()[0].ApiKey)
+	}
+	config.ProviderKeySecret = "test-secret"
+	res = doAuthRequest(handler, "PUT", "/v1/providers/MailGun", `{"apiKey":"key-1"}`, admin)
+	if res.Code != 200 || mailServerConfigs()[0].ApiKey != "key-1" {
+		t.Errorf("Update returned %d, apiKey %s", res.Code, mailServerConfigs()[0].ApiKey)
+	}
+	stored := datastore.(*MockDatastore).overrides["MailGun"]
+	if len(stored.ApiKey) > 0 || len(stored.SealedKey) == 0 || strings.Contains(stored.SealedKey, "key-1") {
+		t.Errorf("apiKey not stored sealed: %+v", stored)
+	}
+
+	// Survives a reload, a restart and a later override of the mode
+	applyConfig(currentConfig(), Config{EmailThrottle: 5, ProviderKeySecret: "test-secret", MailServers: []MailServer{{Name: "MailGun", Url: "http://127.0.0.1:1/", ApiKey: "old"}}})
+	loadProviderOverrides()
+	doAuthRequest(handler, "POST", "/v1/providers/MailGun/drain", "", admin)
+	for s := range serverStatuses() {
+		if s.GetName() == "MailGun" && s.(*MailGunServer).Server.ApiKey != "key-1" {
+			t.Errorf("Mail Server after reload has apiKey %s", s.(*MailGunServer).Server.ApiKey)
+		}
+	}
+	if server := mailServerConfigs()[0]; server.ApiKey != "key-1" || providerOverride("MailGun").Mode != ProviderDraining {
+		t.Errorf("Update lost after reload: %+v, mode %s", server, providerOverride("MailGun").Mode)
+	}
+
+	// A key sealed with another secret is ignored for the config's
+	config.ProviderKeySecret = "other-secret"
+	loadProviderOverrides()
+	if server := mailServerConfigs()[0]; server.ApiKey != "old" {
+		t.Errorf("apiKey sealed with another secret used: %+v", server)
+	}
+	providerOverrides = make(map[string]ProviderOverride)
+
+	fmt.Println("Test Complete.")
+}
@@ -0,0 +1,391 @@
+// Token bucket rate limits and daily quotas for sending
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sustained Rate (per second), Burst size and Daily quota for one bucket.
+// Zero values disable that part of the limit
+type RateLimit struct {
+	Rate  float64
+	Burst int
+	Daily int
+}
+
+// Limits applied to each API key or user, client IP and From domain.
+// The client IP is the connection's remote address unless that is one of
+// the TrustedProxies (addresses or CIDR ranges), when X-Forwarded-For is
+// used instead
+type RateLimitConfig struct {
+	PerClient      RateLimit
+	PerIP          RateLimit
+	PerDomain      RateLimit
+	TrustedProxies []string
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	day    string
+	count  int
+}
+
+// Set of buckets sharing one limit
+type rateLimiter struct {
+	name    string
+	limit   RateLimit
+	buckets map[string]*tokenBucket
+}
+
+// Outcome of a rate limit check
+type rateLimitResult struct {
+	name       string
+	allowed    bool
+	limit      int
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+var rateLimitLock sync.Mutex
+var globalLimiter, clientLimiter, ipLimiter, domainLimiter *rateLimiter
+
+// Limiters for each Mail Server by name
+var providerLimiters map[string]*rateLimiter
+
+var trustedProxies []*net.IPNet
+
+// Maximum idle buckets kept before old ones are dropped
+const maxRateLimitBuckets = 10000
+
+// Build the limiters from the configuration. EmailThrottle is the global
+// limit of sends per second shared by all callers
+func initRateLimits() {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+	globalLimiter = newRateLimiter("global", RateLimit{Rate: float64(currentConfig().EmailThrottle), Burst: currentConfig().EmailThrottle})
+	clientLimiter = newRateLimiter("client", currentConfig().RateLimits.PerClient)
+	ipLimiter = newRateLimiter("ip", currentConfig().RateLimits.PerIP)
+	domainLimiter = newRateLimiter("domain", currentConfig().RateLimits.PerDomain)
+	trustedProxies, _ = parseNetworks(currentConfig().RateLimits.TrustedProxies)
+}
+
+// Parse addresses and CIDR ranges, a single address matching only itself
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", value)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func newRateLimiter(name string, limit RateLimit) *rateLimiter {
+	if limit.Rate > 0 && limit.Burst < 1 {
+		limit.Burst = int(math.Ceil(limit.Rate))
+	}
+	return &rateLimiter{name: name, limit: limit, buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *rateLimiter) enabled() bool {
+	return l != nil && (l.limit.Rate > 0 || l.limit.Daily > 0)
+}
+
+// Refill and return the bucket for key as of now
+func (l *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	if l.limit.Rate > 0 {
+		b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	}
+	b.last = now
+	if day := now.UTC().Format("2006-01-02"); b.day != day {
+		b.day = day
+		b.count = 0
+	}
+	return b
+}
+
+// Drop buckets which have been idle for a day
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > 24*time.Hour {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Check the bucket for key has room for n sends without consuming from it.
+// More sends than the burst need a full bucket and leave it in debt
+func (l *rateLimiter) check(key string, now time.Time, n int) rateLimitResult {
+	b := l.bucket(key, now)
+	result := rateLimitResult{name: l.name, allowed: true, limit: math.MaxInt32, remaining: math.MaxInt32}
+	if l.limit.Rate > 0 {
+		result.limit = l.limit.Burst
+		result.remaining = int(b.tokens)
+		result.reset = time.Duration((float64(l.limit.Burst) - b.tokens) / l.limit.Rate * float64(time.Second))
+		if needed := math.Min(float64(n), float64(l.limit.Burst)); b.tokens < needed {
+			result.allowed = false
+			result.retryAfter = time.Duration((needed - b.tokens) / l.limit.Rate * float64(time.Second))
+		}
+	}
+	if l.limit.Daily > 0 && l.limit.Daily-b.count < result.remaining {
+		midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		result.limit = l.limit.Daily
+		result.remaining = l.limit.Daily - b.count
+		result.reset = midnight.Sub(now)
+		if b.count+n > l.limit.Daily {
+			result.allowed = false
+			result.retryAfter = midnight.Sub(now)
+		}
+	}
+	return result
+}
+
+func (l *rateLimiter) take(key string, now time.Time, n int) {
+	b := l.bucket(key, now)
+	if l.limit.Rate > 0 {
+		b.tokens -= float64(n)
+	}
+	b.count += n
+}
+
+// Check every applicable limit for n sends and consume n from all of them
+// only if all allow it. The most restrictive result is returned
+func takeRateLimits(identity Identity, ip string, from string, n int) rateLimitResult {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+
+	type check struct {
+		limiter *rateLimiter
+		key     string
+	}
+	checks := []check{{globalLimiter, "global"}}
+	if len(identity.ClientId) > 0 {
+		checks = append(checks, check{clientLimiter, identity.ClientId})
+	}
+	checks = append(checks, check{ipLimiter, ip})
+	checks = append(checks, check{domainLimiter, strings.ToLower(from[strings.LastIndex(from, "@")+1:])})
+
+	now := time.Now()
+	result := rateLimitResult{allowed: true, limit: math.MaxInt32, remaining: math.MaxInt32}
+	for _, c := range checks {
+		if !c.limiter.enabled() {
+			continue
+		}
+		r := c.limiter.check(c.key, now, n)
+		if !r.allowed {
+			if result.allowed || r.retryAfter > result.retryAfter {
+				result = r
+			}
+			continue
+		}
+		if result.allowed && r.remaining < result.remaining {
+			result = r
+		}
+	}
+	if !result.allowed {
+		return result
+	}
+	for _, c := range checks {
+		if c.limiter.enabled() {
+			c.limiter.take(c.key, now, n)
+		}
+	}
+	if result.remaining != math.MaxInt32 {
+		result.remaining = int(math.Max(0, float64(result.remaining-n)))
+	}
+	return result
+}
+
+// Address of the client making the request. Behind trusted proxies this
+// is the last address in X-Forwarded-For not added by one of them
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	rateLimitLock.Lock()
+	proxies := trustedProxies
+	rateLimitLock.Unlock()
+	if !trustedProxy(proxies, host) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(address) == nil {
+			break
+		}
+		host = address
+		if !trustedProxy(proxies, address) {
+			break
+		}
+	}
+	return host
+}
+
+func trustedProxy(proxies []*net.IPNet, address string) bool {
+	ip := net.ParseIP(address)
+	for _, network := range proxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add X-RateLimit-* headers, plus Retry-After when the request is refused
+func setRateLimitHeaders(w http.ResponseWriter, result rateLimitResult) {
+	if result.limit == math.MaxInt32 {
+		return
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.reset.Seconds()))))
+	if !result.allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(result.retryAfter.Seconds())))))
+	}
+}
+
+// Build per Mail Server limiters from the configuration, restoring today's
+// usage from the Datastore so daily quotas survive restarts
+func initProviderLimits() {
+	usage := map[string]int{}
+	if datastore != nil {
+		usage = datastore.RetrieveProviderUsage(time.Now().UTC().Format("2006-01-02"))
+	}
+
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+	now := time.Now()
+	providerLimiters = make(map[string]*rateLimiter)
+	for _, conf := range currentConfig().MailServers {
+		limiter := newRateLimiter(conf.Name, conf.Limits)
+		limiter.bucket(conf.Name, now).count = usage[conf.Name]
+		providerLimiters[conf.Name] = limiter
+	}
+}
+
+// Whether the Mail Server may send now and has count sends left of its
+// daily quota
+func providerAvailable(name string, count int) bool {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+	limiter := providerLimiters[name]
+	if !limiter.enabled() {
+		return true
+	}
+	now := time.Now()
+	if !limiter.check(name, now, 1).allowed {
+		return false
+	}
+	return limiter.limit.Daily == 0 || limiter.limit.Daily-limiter.bucket(name, now).count >= count
+}
+
+// Reserve n sends of the Mail Server's daily quota, all or none, so a
+// request is never cut short by the quota once it starts sending
+func reserveProviderSends(name string, n int) bool {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+	limiter := providerLimiters[name]
+	if !limiter.enabled() || limiter.limit.Daily == 0 {
+		return true
+	}
+	b := limiter.bucket(name, time.Now())
+	if b.count+n > limiter.limit.Daily {
+		return false
+	}
+	b.count += n
+	return true
+}
+
+// Return reserved sends which failed or were never made
+func releaseProviderSends(name string, n int) {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+	if limiter := providerLimiters[name]; limiter.enabled() {
+		b := limiter.bucket(name, time.Now())
+		b.count = int(math.Max(0, float64(b.count-n)))
+	}
+}
+
+// Wait until the Mail Server's rate allows another send and take it.
+// False if ctx is done first
+func paceProviderSend(ctx context.Context, name string) bool {
+	for {
+		rateLimitLock.Lock()
+		limiter := providerLimiters[name]
+		if limiter == nil || limiter.limit.Rate <= 0 {
+			rateLimitLock.Unlock()
+			return true
+		}
+		b := limiter.bucket(name, time.Now())
+		if b.tokens >= 1 {
+			b.tokens--
+			rateLimitLock.Unlock()
+			return true
+		}
+		wait := time.Duration((1 - b.tokens) / limiter.limit.Rate * float64(time.Second))
+		rateLimitLock.Unlock()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Persist a successful send against the Mail Server's daily usage
+func recordProviderSend(ctx context.Context, store Datastore, name string) {
+	if store != nil {
+		err := store.IncrementProviderUsage(name, time.Now().UTC().Format("2006-01-02"))
+		if err != nil {
+			logFrom(ctx).Error("Error storing provider usage", "provider", name, "error", err)
+		}
+	}
+}
+
+// Sends made today by a Mail Server and whether it is currently over its
+// rate or daily quota
+func providerUsage(name string) (int, bool) {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+	limiter := providerLimiters[name]
+	if !limiter.enabled() {
+		return 0, false
+	}
+	now := time.Now()
+	return limiter.bucket(name, now).count, !limiter.check(name, now, 1).allowed
+}
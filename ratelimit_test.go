@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientRateLimit(t *testing.T) {
+	fmt.Println("Running Test: TestClientRateLimit")
+
+	// Setup
+	datastore = NewMockDatastore()
+	Servers = map[MailSender]bool{&MockServer{}: true}
+	config = Config{RateLimits: RateLimitConfig{PerClient: RateLimit{Rate: 0.01, Burst: 2}}}
+	initRateLimits()
+	initProviderLimits()
+	identity := Identity{Name: "client", ClientId: "key:client", Scopes: []string{ScopeSend}}
+	body := `{"to":["a@example.com"],"from":"me@example.com","subject":"Hi","text":"Hi"}`
+
+	for i := 0; i < 2; i++ {
+		res := sendAs(identity, body)
+		if res.Code != 200 {
+			t.Fatalf("Send %d returned %d should be 200.", i, res.Code)
+		}
+	}
+	res := sendAs(identity, body)
+	if res.Code != 429 {
+		t.Errorf("Send over limit returned %d should be 429.", res.Code)
+	}
+	if len(res.Header().Get("Retry-After")) == 0 || res.Header().Get("X-RateLimit-Remaining") != "0" || res.Header().Get("X-RateLimit-Limit") != "2" {
+		t.Errorf("Missing rate limit headers: %v", res.Header())
+	}
+
+	// Other clients have their own bucket
+	res = sendAs(Identity{Name: "other", ClientId: "key:other", Scopes: []string{ScopeSend}}, body)
+	if res.Code != 200 {
+		t.Errorf("Send by other client returned %d should be 200.", res.Code)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestDomainDailyQuota(t *testing.T) {
+	fmt.Println("Running Test: TestDomainDailyQuota")
+
+	// Setup
+	config = Config{RateLimits: RateLimitConfig{
+		PerClient: RateLimit{Daily: 5},
+		PerDomain: RateLimit{Daily: 1},
+	}}
+	initRateLimits()
+
+	if !takeRateLimits(Identity{ClientId: "a"}, "10.0.0.1", "me@example.com", 1).allowed {
+		t.Fatalf("First send should be allowed.")
+	}
+	result := takeRateLimits(Identity{ClientId: "b"}, "10.0.0.2", "you@Example.com", 1)
+	if result.allowed || result.retryAfter <= 0 {
+		t.Errorf("Second send from the domain should be refused until tomorrow.")
+	}
+	if !takeRateLimits(Identity{ClientId: "b"}, "10.0.0.2", "you@other.com", 1).allowed {
+		t.Errorf("Send from another domain should be allowed.")
+	}
+
+	// Refused sends do not use up client quota
+	if r := takeRateLimits(Identity{ClientId: "c"}, "10.0.0.3", "x@example.com", 1); r.allowed {
+		t.Errorf("Send from exhausted domain should be refused.")
+	}
+	takeRateLimits(Identity{ClientId: "c"}, "10.0.0.3", "x@third.com", 1)
+	if count := clientLimiter.buckets["c"].count; count != 1 {
+		t.Errorf("Client used %d sends should be 1.", count)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+// Helper functions
+func sendAs(identity Identity, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/messages/", strings.NewReader(body))
+	res := httptest.NewRecorder()
+	messageHandler(res, withIdentity(req, identity))
+	return res
+}
+
+func TestRateLimitCountsSends(t *testing.T) {
+	fmt.Println("Running Test: TestRateLimitCountsSends")
+
+	// Setup
+	config = Config{RateLimits: RateLimitConfig{PerClient: RateLimit{Rate: 0.01, Burst: 5, Daily: 12}}}
+	initRateLimits()
+	client := Identity{ClientId: "bulk"}
+
+	// Each message takes a unit, a refused request takes none
+	if r := takeRateLimits(client, "10.0.0.1", "me@example.com", 3); !r.allowed || r.remaining != 2 {
+		t.Errorf("Request for 3 sends returned %+v", r)
+	}
+	if r := takeRateLimits(client, "10.0.0.1", "me@example.com", 3); r.allowed {
+		t.Errorf("Request for 3 sends with 2 left allowed")
+	}
+	if count := clientLimiter.buckets["bulk"].count; count != 3 {
+		t.Errorf("Client used %d sends should be 3.", count)
+	}
+
+	// More than the burst needs a full bucket, the daily quota is exact
+	clientLimiter.buckets["bulk"].tokens = 5
+	if r := takeRateLimits(client, "10.0.0.1", "me@example.com", 8); !r.allowed {
+		t.Errorf("Request for 8 sends with a full bucket refused")
+	}
+	clientLimiter.buckets["bulk"].tokens = 5
+	if r := takeRateLimits(client, "10.0.0.1", "me@example.com", 2); r.allowed || r.name != "client" {
+		t.Errorf("Request over the daily quota returned %+v", r)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestClientIP(t *testing.T) {
+	fmt.Println("Running Test: TestClientIP")
+
+	// Setup
+	config = Config{RateLimits: RateLimitConfig{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"}}}
+	initRateLimits()
+
+	for _, test := range []struct {
+		remote    string
+		forwarded string
+		ip        string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		{"203.0.113.5:1234", "198.51.100.7", "203.0.113.5"},
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+		{"10.1.2.3:1234", "198.51.100.7", "198.51.100.7"},
+		{"10.1.2.3:1234", "6.6.6.6, 198.51.100.7, 192.0.2.1", "198.51.100.7"},
+		{"192.0.2.1:1234", "198.51.100.7, not-an-ip", "192.0.2.1"},
+	} {
+		req := httptest.NewRequest("POST", "/messages/", nil)
+		req.RemoteAddr = test.remote
+		if len(test.forwarded) > 0 {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if ip := clientIP(req); ip != test.ip {
+			t.Errorf("Client IP from %s forwarded for %q is %s should be %s", test.remote, test.forwarded, ip, test.ip)
+		}
+	}
+
+	proxied := defaultConfig()
+	proxied.RateLimits.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+	if err := validateConfig(proxied); err != nil {
+		t.Errorf("Valid trusted proxies rejected: %v", err)
+	}
+	proxied.RateLimits.TrustedProxies = []string{"10.0.0.0/33"}
+	if err := validateConfig(proxied); err == nil {
+		t.Errorf("Invalid trusted proxy accepted")
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestProviderQuota(t *testing.T) {
+	fmt.Println("Running Test: TestProviderQuota")
+
+	// Setup
+	datastore = NewMockDatastore()
+	config = Config{MailServers: []MailServer{{Name: "MockServer", Limits: RateLimit{Daily: 2}}}}
+	Servers = map[MailSender]bool{&MockServer{}: true}
+	today := time.Now().UTC().Format("2006-01-02")
+	datastore.IncrementProviderUsage("MockServer", today)
+
+	// Usage survives a restart
+	initProviderLimits()
+	if chooseMailSender(context.Background(), 1) == nil {
+		t.Fatalf("Provider with quota left should be selected.")
+	}
+	if !reserveProviderSends("MockServer", 1) {
+		t.Fatalf("Provider with quota left should take a send.")
+	}
+	recordProviderSend(context.Background(), datastore, "MockServer")
+	if chooseMailSender(context.Background(), 1) != nil || reserveProviderSends("MockServer", 1) {
+		t.Errorf("Provider over its daily quota should be skipped.")
+	}
+	if datastore.RetrieveProviderUsage(today)["MockServer"] != 2 {
+		t.Errorf("Provider usage should be persisted.")
+	}
+
+	res := httptest.NewRecorder()
+	statusHandler(res, httptest.NewRequest("GET", "/status", nil))
+	var status map[string]struct {
+		DailyRemaining int  `json:"dailyRemaining"`
+		RateLimited    bool `json:"rateLimited"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &status)
+	if status["MockServer"].DailyRemaining != 0 || !status["MockServer"].RateLimited {
+		t.Errorf("Unexpected status %s", res.Body.String())
+	}
+
+	// A message personalized for several recipients needs quota for each
+	datastore = NewMockDatastore()
+	config = Config{MailServers: []MailServer{{Name: "MockServer", Limits: RateLimit{Daily: 2}}}}
+	initRateLimits()
+	initProviderLimits()
+	handler, key := buildTestHandler(), buildTestKey(ScopeSend)
+	res = doAuthRequest(handler, "POST", "/messages/", `{"to":["a@example.com","b@example.com","c@example.com"],"from":"me@example.com","subject":"Hi","text":"Hi {{.Email}}"}`, key)
+	if res.Code != 500 || datastore.RetrieveProviderUsage(today)["MockServer"] != 0 {
+		t.Errorf("Message over the quota returned %d with usage %d", res.Code, datastore.RetrieveProviderUsage(today)["MockServer"])
+	}
+	res = doAuthRequest(handler, "POST", "/messages/", `{"to":["a@example.com","b@example.com"],"from":"me@example.com","subject":"Hi","text":"Hi {{.Email}}"}`, key)
+	if res.Code != 200 || datastore.RetrieveProviderUsage(today)["MockServer"] != 2 {
+		t.Errorf("Message within the quota returned %d with usage %d", res.Code, datastore.RetrieveProviderUsage(today)["MockServer"])
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestProviderReservation(t *testing.T) {
+	fmt.Println("Running Test: TestProviderReservation")
+
+	// Setup
+	datastore = NewMockDatastore()
+	config = Config{MailServers: []MailServer{{Name: "MockServer", Limits: RateLimit{Daily: 3}}}}
+	initProviderLimits()
+	if !reserveProviderSends("MockServer", 2) {
+		t.Fatalf("Reservation within quota refused.")
+	}
+	if used, _ := providerUsage("MockServer"); reserveProviderSends("MockServer", 2) || used != 2 {
+		t.Errorf("Reservation over quota should be refused in full, usage %d", used)
+	}
+	releaseProviderSends("MockServer", 1)
+	if !reserveProviderSends("MockServer", 2) {
+		t.Errorf("Released sends should be reservable again.")
+	}
+	if used, _ := providerUsage("MockServer"); used != 3 {
+		t.Errorf("Usage should be 3 after reservations, not %d", used)
+	}
+	if !paceProviderSend(context.Background(), "MockServer") {
+		t.Errorf("Server without a rate should not wait.")
+	}
+
+	config = Config{MailServers: []MailServer{{Name: "MockServer", Limits: RateLimit{Rate: 0.001, Burst: 1}}}}
+	initProviderLimits()
+	ctx, cancel := context.WithCancel(context.Background())
+	if !paceProviderSend(ctx, "MockServer") {
+		t.Fatalf("First send within burst should not wait.")
+	}
+	cancel()
+	if paceProviderSend(ctx, "MockServer") {
+		t.Errorf("Pacing should give up when the context is done.")
+	}
+
+	fmt.Println("Test Complete.")
+}
@@ -0,0 +1,185 @@
+// Method aware request routing with path parameters
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Routes requests by method and path. Patterns are paths whose segments
+// may be parameters, e.g. /v1/contacts/{id}/tags/{tag}. A trailing slash
+// is ignored and literal segments win over parameters
+type Router struct {
+	routes   []*route
+	prefixes []prefixRoute
+
+	// Called when no route matches the path
+	NotFound http.HandlerFunc
+
+	// Called when routes match the path but not the method, after the
+	// Allow header has been set
+	MethodNotAllowed http.HandlerFunc
+}
+
+type route struct {
+	pattern  string
+	segments []string
+	handlers map[string]http.HandlerFunc
+}
+
+type prefixRoute struct {
+	prefix  string
+	handler http.Handler
+}
+
+type pathParamsKey struct{}
+
+func NewRouter() *Router {
+	return &Router{
+		NotFound: func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, "Not found.", 404)
+		},
+		MethodNotAllowed: func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, "Method not allowed.", 405)
+		},
+	}
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if len(path) == 0 {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+// Route method requests for pattern to fn. GET routes also answer HEAD
+func (r *Router) Handle(method string, pattern string, fn http.HandlerFunc) {
+	for _, existing := range r.routes {
+		if existing.pattern == pattern {
+			existing.handlers[method] = fn
+			return
+		}
+	}
+	r.routes = append(r.routes, &route{pattern: pattern, segments: splitPath(pattern), handlers: map[string]http.HandlerFunc{method: fn}})
+}
+
+// Route GET requests for any path under prefix to handler
+func (r *Router) HandlePrefix(prefix string, handler http.Handler) {
+	r.prefixes = append(r.prefixes, prefixRoute{prefix, handler})
+}
+
+// Path parameters if the route matches segments
+func (rt *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, segment := range rt.segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if len(segments[i]) == 0 {
+				return nil, false
+			}
+			params[segment[1:len(segment)-1]] = segments[i]
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// Whether rt should be preferred over other, comparing literal segments
+// from the left
+func (rt *route) moreSpecific(other *route) bool {
+	for i := range rt.segments {
+		literal := !strings.HasPrefix(rt.segments[i], "{")
+		otherLiteral := !strings.HasPrefix(other.segments[i], "{")
+		if literal != otherLiteral {
+			return literal
+		}
+	}
+	return false
+}
+
+func (rt *route) handler(method string) (http.HandlerFunc, bool) {
+	fn, ok := rt.handlers[method]
+	if !ok && method == "HEAD" {
+		fn, ok = rt.handlers["GET"]
+	}
+	return fn, ok
+}
+
+func (rt *route) allowed() []string {
+	methods := []string{"OPTIONS"}
+	for method := range rt.handlers {
+		methods = append(methods, method)
+		if method == "GET" {
+			methods = append(methods, "HEAD")
+		}
+	}
+	return methods
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	segments := splitPath(req.URL.Path)
+	var best *route
+	var bestParams map[string]string
+	allowed := map[string]bool{}
+	for _, rt := range r.routes {
+		params, ok := rt.match(segments)
+		if !ok {
+			continue
+		}
+		for _, method := range rt.allowed() {
+			allowed[method] = true
+		}
+		if _, ok := rt.handler(req.Method); ok && (best == nil || rt.moreSpecific(best)) {
+			best, bestParams = rt, params
+		}
+	}
+
+	if best != nil {
+		if span := spanFrom(req.Context()); span != nil {
+			span.SetName(req.Method + " " + best.pattern)
+			span.SetAttributes("http.route", best.pattern)
+		}
+		fn, _ := best.handler(req.Method)
+		fn(w, req.WithContext(context.WithValue(req.Context(), pathParamsKey{}, bestParams)))
+		return
+	}
+	if len(allowed) > 0 {
+		methods := make([]string, 0, len(allowed))
+		for method := range allowed {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		if req.Method == "OPTIONS" {
+			w.WriteHeader(204)
+			return
+		}
+		r.MethodNotAllowed(w, req)
+		return
+	}
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(req.URL.Path, prefix.prefix) {
+			if req.Method != "GET" && req.Method != "HEAD" {
+				w.Header().Set("Allow", "GET, HEAD")
+				r.MethodNotAllowed(w, req)
+				return
+			}
+			prefix.handler.ServeHTTP(w, req)
+			return
+		}
+	}
+	r.NotFound(w, req)
+}
+
+// Value of a path parameter of the route handling req
+func pathParam(req *http.Request, name string) string {
+	params, _ := req.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	fmt.Println("Running Test: TestRouter")
+
+	// Setup
+	router := NewRouter()
+	reply := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, "%s %s %s", name, pathParam(req, "id"), pathParam(req, "tag"))
+		}
+	}
+	router.Handle("GET", "/items/", reply("list"))
+	router.Handle("GET", "/items/{id}", reply("get"))
+	router.Handle("DELETE", "/items/{id}", reply("delete"))
+	router.Handle("GET", "/items/new", reply("new"))
+	router.Handle("PUT", "/items/{id}/tags/{tag}", reply("tag"))
+
+	for _, test := range []struct {
+		method string
+		url    string
+		code   int
+		body   string
+	}{
+		{"GET", "/items", 200, "list  "},
+		{"GET", "/items/", 200, "list  "},
+		{"GET", "/items/42", 200, "get 42 "},
+		{"GET", "/items/42/", 200, "get 42 "},
+		{"HEAD", "/items/42", 200, "get 42 "},
+		{"DELETE", "/items/42", 200, "delete 42 "},
+		{"GET", "/items/new", 200, "new  "},
+		{"DELETE", "/items/new", 200, "delete new "},
+		{"PUT", "/items/42/tags/blue", 200, "tag 42 blue"},
+		{"PUT", "/items/42/tags/", 404, "Not found.\n"},
+		{"GET", "/items/42/other", 404, "Not found.\n"},
+		{"GET", "/", 404, "Not found.\n"},
+	} {
+		res := doRequest(router.ServeHTTP, test.method, test.url, "")
+		if res.Code != test.code || res.Body.String() != test.body {
+			t.Errorf("%s %s returned %d %q should be %d %q", test.method, test.url, res.Code, res.Body.String(), test.code, test.body)
+		}
+	}
+
+	res := doRequest(router.ServeHTTP, "POST", "/items/42", "")
+	if res.Code != 405 || res.Header().Get("Allow") != "DELETE, GET, HEAD, OPTIONS" {
+		t.Errorf("POST /items/42 returned %d with Allow %q", res.Code, res.Header().Get("Allow"))
+	}
+	res = doRequest(router.ServeHTTP, "OPTIONS", "/items/42/tags/blue", "")
+	if res.Code != 204 || res.Header().Get("Allow") != "OPTIONS, PUT" {
+		t.Errorf("OPTIONS returned %d with Allow %q", res.Code, res.Header().Get("Allow"))
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestVersionedRoutes(t *testing.T) {
+	fmt.Println("Running Test: TestVersionedRoutes")
+
+	// Setup
+	datastore = NewMockDatastore()
+	config = Config{EmailThrottle: 5, PingPeriod: 60}
+	handler, key := buildTestHandler(), buildTestKey(ScopeAdmin)
+	contact, _ := datastore.StoreContact(Contact{Email: "a@example.com", Tags: []string{"one"}})
+	id := contact.Id.Hex()
+
+	// Legacy paths answer the same as /v1
+	for _, url := range []string{"/contacts/" + id, "/contacts/?id=" + id, "/suppressions/", "/apikeys/", "/users/", "/providers/", "/status", "/loglevel", "/history"} {
+		legacy := doAuthRequest(handler, "GET", url, "", key)
+		versioned := doAuthRequest(handler, "GET", "/v1"+url, "", key)
+		if legacy.Code != 200 || versioned.Code != legacy.Code || versioned.Body.String() != legacy.Body.String() {
+			t.Errorf("GET %s returned %d, /v1%s returned %d", url, legacy.Code, url, versioned.Code)
+		}
+	}
+
+	res := doAuthRequest(handler, "PUT", "/v1/contacts/"+id+"/tags/two", "", key)
+	if res.Code != 200 {
+		t.Errorf("PUT /v1/contacts/{id}/tags/{tag} returned %d should be 200", res.Code)
+	}
+	res = doAuthRequest(handler, "GET", "/v1/contacts/not-an-id", "", key)
+	if res.Code != 404 {
+		t.Errorf("GET of malformed contact ID returned %d should be 404", res.Code)
+	}
+	res = doAuthRequest(handler, "POST", "/v1/status", "", key)
+	if res.Code != 405 || res.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Errorf("POST /v1/status returned %d with Allow %q", res.Code, res.Header().Get("Allow"))
+	}
+	res = doAuthRequest(handler, "GET", "/v2/status", "", key)
+	if res.Code != 404 {
+		t.Errorf("GET /v2/status returned %d should be 404", res.Code)
+	}
+
+	fmt.Println("Test Complete.")
+}
@@ -0,0 +1,200 @@
+// Secret config values looked up from the environment, files, Vault or
+// GCE metadata rather than written into the config file
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/cloud/compute/metadata"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Looks up a secret by name. A config value such as
+// "file:/run/secrets/mailgun" is passed to the provider registered for its
+// prefix, values without a known prefix are used as they are
+type SecretProvider interface {
+	Lookup(name string) (string, error)
+}
+
+// Providers available to every config, Vault is added from the config
+var secretProviders = map[string]SecretProvider{
+	"env":  envSecrets{},
+	"file": fileSecrets{},
+	"gce":  gceSecrets{},
+}
+
+type VaultConfig struct {
+	Address   string // e.g. https://vault.example.com:8200, defaults to VAULT_ADDR
+	Token     string // Token or secret reference to one, defaults to VAULT_TOKEN
+	Namespace string // Vault Enterprise namespace, optional
+}
+
+// env:NAME reads an environment variable
+type envSecrets struct{}
+
+func (envSecrets) Lookup(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// file:/path reads a file, such as a Docker or Kubernetes secret mount.
+// A trailing newline is dropped
+type fileSecrets struct{}
+
+func (fileSecrets) Lookup(name string) (string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// gce:attribute reads a GCE instance metadata attribute
+type gceSecrets struct{}
+
+// Looks up instance metadata attributes, replaced in tests
+var instanceAttribute = metadata.InstanceAttributeValue
+
+func (gceSecrets) Lookup(name string) (string, error) {
+	if !gce {
+		return "", errors.New("not running on GCE")
+	}
+	return instanceAttribute(name)
+}
+
+// vault:path#key reads a key from a secret in a Vault compatible KV
+// engine, e.g. vault:secret/data/maelstrom#mailgun for KV version 2
+type vaultSecrets struct {
+	conf   VaultConfig
+	client *http.Client
+}
+
+func (v *vaultSecrets) Lookup(name string) (string, error) {
+	parts := strings.SplitN(name, "#", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", fmt.Errorf("Vault secret %s should be path#key", name)
+	}
+	if len(v.conf.Address) == 0 {
+		return "", errors.New("no Vault address configured")
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(v.conf.Address, "/")+"/v1/"+strings.TrimLeft(parts[0], "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.conf.Token)
+	if len(v.conf.Namespace) > 0 {
+		req.Header.Set("X-Vault-Namespace", v.conf.Namespace)
+	}
+	res, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("Vault returned %d for %s", res.StatusCode, parts[0])
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&secret)
+	if err != nil {
+		return "", fmt.Errorf("invalid Vault response for %s: %v", parts[0], err)
+	}
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		// KV version 2 wraps the values with their metadata
+		data = nested
+	}
+	value, ok := data[parts[1]].(string)
+	if !ok {
+		return "", fmt.Errorf("no key %s in Vault secret %s", parts[1], parts[0])
+	}
+	return value, nil
+}
+
+// The providers for a config, including Vault as it configures
+func secretProvidersFor(vault VaultConfig) (map[string]SecretProvider, error) {
+	providers := make(map[string]SecretProvider, len(secretProviders)+1)
+	for scheme, provider := range secretProviders {
+		providers[scheme] = provider
+	}
+	if len(vault.Address) == 0 {
+		vault.Address = os.Getenv("VAULT_ADDR")
+	}
+	if len(vault.Token) == 0 {
+		vault.Token = os.Getenv("VAULT_TOKEN")
+	}
+	token, err := resolveSecret(vault.Token, providers)
+	vault.Token = token
+	providers["vault"] = &vaultSecrets{conf: vault, client: &http.Client{Timeout: 10 * time.Second}}
+	return providers, err
+}
+
+// Whether value is a reference to a secret rather than a plain value
+func isSecretReference(value string) bool {
+	parts := strings.SplitN(value, ":", 2)
+	_, ok := secretProviders[parts[0]]
+	return len(parts) == 2 && (ok || parts[0] == "vault")
+}
+
+// The secret a config value refers to, or the value itself
+func resolveSecret(value string, providers map[string]SecretProvider) (string, error) {
+	parts := strings.SplitN(value, ":", 2)
+	provider, ok := providers[parts[0]]
+	if len(parts) != 2 || !ok {
+		return value, nil
+	}
+	return provider.Lookup(parts[1])
+}
+
+// Replace secret references in conf with the secrets. On GCE empty
+// values fall back to the instance metadata attributes used before
+// references were supported
+func resolveSecrets(conf *Config) configErrors {
+	errs := configErrors{}
+	providers, err := secretProvidersFor(conf.Vault)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("vault.token: %v", err))
+	}
+
+	type secret struct {
+		path      string
+		value     *string
+		attribute string
+	}
+	secrets := []secret{
+		{"mongoUrl", &conf.MongoUrl, "mongoUrl"},
+		{"unsubscribeSecret", &conf.UnsubscribeSecret, "unsubscribeSecret"},
+		{"providerKeySecret", &conf.ProviderKeySecret, "providerKeySecret"},
+		{"oidc.clientSecret", &conf.OIDC.ClientSecret, ""},
+	}
+	for i := range conf.MailServers {
+		server := &conf.MailServers[i]
+		secrets = append(secrets,
+			secret{fmt.Sprintf("mailServers.%d.apiKey", i), &server.ApiKey, server.Name},
+			secret{fmt.Sprintf("mailServers.%d.pingKey", i), &server.PingKey, ""})
+	}
+	for _, s := range secrets {
+		if gce && len(*s.value) == 0 && len(s.attribute) > 0 {
+			*s.value, _ = instanceAttribute(s.attribute)
+			continue
+		}
+		value, err := resolveSecret(*s.value, providers)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", s.path, err))
+			continue
+		}
+		*s.value = value
+	}
+	return errs
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/cloud/compute/metadata"
+)
+
+func TestResolveSecret(t *testing.T) {
+	fmt.Println("Running Test: TestResolveSecret")
+
+	// Setup
+	dir, _ := ioutil.TempDir("", "maelstrom")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mailgun")
+	ioutil.WriteFile(path, []byte("file-key\n"), 0600)
+	os.Setenv("MAELSTROM_TEST_SECRET", "env-key")
+	defer os.Unsetenv("MAELSTROM_TEST_SECRET")
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "env-key" {
+			w.WriteHeader(403)
+			return
+		}
+		switch req.URL.Path {
+		case "/v1/secret/data/maelstrom":
+			fmt.Fprint(w, `{"data":{"data":{"mailgun":"vault-v2-key"},"metadata":{"version":3}}}`)
+		case "/v1/kv/maelstrom":
+			fmt.Fprint(w, `{"data":{"mailgun":"vault-v1-key"}}`)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer vault.Close()
+	providers, err := secretProvidersFor(VaultConfig{Address: vault.URL, Token: "env:MAELSTROM_TEST_SECRET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for value, expected := range map[string]string{
+		"plain-key":                           "plain-key",
+		"https://api.mailgun.net/v3/":         "https://api.mailgun.net/v3/",
+		"env:MAELSTROM_TEST_SECRET":           "env-key",
+		"file:" + path:                        "file-key",
+		"vault:secret/data/maelstrom#mailgun": "vault-v2-key",
+		"vault:/kv/maelstrom#mailgun":         "vault-v1-key",
+	} {
+		secret, err := resolveSecret(value, providers)
+		if err != nil || secret != expected {
+			t.Errorf("%s resolved to %s, %v should be %s", value, secret, err, expected)
+		}
+	}
+	for _, invalid := range []string{
+		"env:MAELSTROM_TEST_MISSING",
+		"file:" + filepath.Join(dir, "missing"),
+		"vault:secret/data/maelstrom#sendgrid",
+		"vault:secret/data/other#mailgun",
+		"vault:secret/data/maelstrom",
+		"gce:mailgun",
+	} {
+		if _, err := resolveSecret(invalid, providers); err == nil {
+			t.Errorf("%s resolved without error", invalid)
+		}
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestLoadConfigSecrets(t *testing.T) {
+	fmt.Println("Running Test: TestLoadConfigSecrets")
+
+	// Setup
+	dir, _ := ioutil.TempDir("", "maelstrom")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "mailgun"), []byte("file-key\n"), 0600)
+	path := filepath.Join(dir, "conf.json")
+	writeTestConfig(t, path, `{"mailServers":[{"name":"MailGun","apiKey":"file:`+filepath.Join(dir, "mailgun")+`"}],"pingPeriod":60}`)
+
+	conf, err := loadConfig(path)
+	if err != nil || conf.MailServers[0].ApiKey != "file-key" {
+		t.Errorf("apiKey not read from file: %s %v", conf.MailServers[0].ApiKey, err)
+	}
+
+	// Missing secrets are reported with the setting that refers to them
+	writeTestConfig(t, path, `{"mailServers":[{"name":"MailGun","apiKey":"file:`+filepath.Join(dir, "missing")+`"}],"pingPeriod":60,"unsubscribeSecret":"env:MAELSTROM_TEST_MISSING"}`)
+	_, err = loadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "mailServers.0.apiKey") || !strings.Contains(err.Error(), "unsubscribeSecret") {
+		t.Errorf("Missing secrets not reported: %v", err)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestGCEMetadataDefaults(t *testing.T) {
+	fmt.Println("Running Test: TestGCEMetadataDefaults")
+
+	// Setup
+	attributes := map[string]string{"mongoUrl": "mongo.internal:27017", "MailGun": "gce-mailgun-key"}
+	instanceAttribute = func(name string) (string, error) {
+		return attributes[name], nil
+	}
+	gce = true
+	defer func() {
+		instanceAttribute = metadata.InstanceAttributeValue
+		gce = false
+	}()
+
+	// The shipped conf.json leaves them to the metadata
+	conf, err := loadConfig("conf.json")
+	if err != nil {
+		t.Fatalf("Could not load conf.json: %v", err)
+	}
+	if conf.MongoUrl != "mongo.internal:27017" {
+		t.Errorf("mongoUrl is %s should come from the instance metadata", conf.MongoUrl)
+	}
+	for _, server := range conf.MailServers {
+		if server.Name == "MailGun" && server.ApiKey != "gce-mailgun-key" {
+			t.Errorf("MailGun apiKey is %s should come from the instance metadata", server.ApiKey)
+		}
+	}
+
+	fmt.Println("Test Complete.")
+}
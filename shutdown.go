@@ -0,0 +1,84 @@
+// Graceful shutdown on SIGTERM or SIGINT
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Set once shutdown starts, failing readiness so no new traffic is routed
+var shuttingDown int32
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+func shutdownTimeout() time.Duration {
+	timeout := currentConfig().ShutdownTimeout
+	if timeout <= 0 {
+		timeout = 30
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// How long readiness fails before the listener closes, giving load
+// balancers time to stop routing new requests here
+func shutdownDrain() time.Duration {
+	return time.Duration(currentConfig().ShutdownDrainSeconds) * time.Second
+}
+
+// Shut the server down on SIGTERM or SIGINT. The returned channel is
+// closed once shutdown has finished
+func handleShutdown(server *http.Server) chan struct{} {
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		Log.Info("Shutting down", "signal", sig.String(), "drain", shutdownDrain().String(), "timeout", shutdownTimeout().String())
+		shutdown(server, shutdownDrain(), shutdownTimeout())
+		close(done)
+	}()
+	return done
+}
+
+// Fail readiness and keep serving for drain, then stop accepting requests
+// and wait up to timeout for those in flight, including their sends, to
+// finish. Then stop the pinger, export queued spans and close the
+// Datastore and log file
+func shutdown(server *http.Server, drain time.Duration, timeout time.Duration) error {
+	atomic.StoreInt32(&shuttingDown, 1)
+	if drain > 0 {
+		Log.Info("Draining before shutdown", "drain", drain.String())
+		time.Sleep(drain)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		inFlight := 0
+		for server := range serverStatuses() {
+			inFlight += sendsInFlight(server.GetName())
+		}
+		Log.Warn("Shutdown timed out, closing remaining connections", "error", err, "sends_in_flight", inFlight)
+		server.Close()
+	}
+
+	stopPing()
+	flushTracing(timeout)
+	if datastore != nil {
+		datastore.Close()
+	}
+	Log.Info("Shutdown complete")
+	if logFile != nil {
+		logFile.Close()
+	}
+	return err
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Server whose /slow requests hold a send in flight until release is closed
+func startSlowServer(t *testing.T, release chan struct{}) (*http.Server, string, chan struct{}) {
+	started := make(chan struct{}, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, req *http.Request) {
+		beginSend("MockServer")
+		defer endSend("MockServer")
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(200)
+	})
+	mux.HandleFunc("/readyz", readyzHandler)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	return server, "http://" + listener.Addr().String(), started
+}
+
+func TestShutdown(t *testing.T) {
+	fmt.Println("Running Test: TestShutdown")
+
+	// Setup
+	db := NewMockDatastore()
+	datastore = db
+	config = Config{PingPeriod: 60, EmailThrottle: 5}
+	Servers = map[MailSender]bool{&MockServer{}: true}
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	initiatePing()
+	release := make(chan struct{})
+	server, url, started := startSlowServer(t, release)
+
+	status := make(chan int, 1)
+	go func() {
+		res, err := http.Get(url + "/slow")
+		if err != nil {
+			status <- 0
+			return
+		}
+		res.Body.Close()
+		status <- res.StatusCode
+	}()
+	<-started
+
+	result := make(chan error, 1)
+	go func() {
+		result <- shutdown(server, 0, 5*time.Second)
+	}()
+
+	// Waits for the send in flight, reporting not ready meanwhile
+	select {
+	case err := <-result:
+		t.Fatalf("Shutdown returned %v with a send in flight", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	report, ready := checkReadiness()
+	if ready || report.Checks["shutdown"].Ok {
+		t.Errorf("Ready while shutting down: %v", report)
+	}
+
+	close(release)
+	if code := <-status; code != 200 {
+		t.Errorf("Request in flight returned %d should be 200", code)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+	if pinging() {
+		t.Errorf("Pinger not stopped")
+	}
+	if !db.closed {
+		t.Errorf("Datastore not closed")
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestShutdownDrain(t *testing.T) {
+	fmt.Println("Running Test: TestShutdownDrain")
+
+	// Setup
+	datastore = NewMockDatastore()
+	config = Config{PingPeriod: 60, EmailThrottle: 5}
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	release := make(chan struct{})
+	defer close(release)
+	server, url, _ := startSlowServer(t, release)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- shutdown(server, 500*time.Millisecond, time.Second)
+	}()
+
+	// Still listening, reporting not ready for the load balancer
+	time.Sleep(100 * time.Millisecond)
+	res, err := http.Get(url + "/readyz")
+	if err != nil {
+		t.Fatalf("Listener closed during the drain delay: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 503 {
+		t.Errorf("GET /readyz during the drain delay returned %d should be 503", res.StatusCode)
+	}
+	select {
+	case <-result:
+		t.Errorf("Shutdown finished before the drain delay")
+	default:
+	}
+	if err := <-result; err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+	if _, err := http.Get(url + "/readyz"); err == nil {
+		t.Errorf("Listener still open after shutdown")
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	fmt.Println("Running Test: TestShutdownTimeout")
+
+	// Setup
+	datastore = NewMockDatastore()
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	release := make(chan struct{})
+	defer close(release)
+	server, url, started := startSlowServer(t, release)
+
+	go http.Get(url + "/slow")
+	<-started
+
+	start := time.Now()
+	err := shutdown(server, 0, 50*time.Millisecond)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v should be %v", err, context.DeadlineExceeded)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Shutdown took %v past its deadline", time.Since(start))
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestDatastoreAfterClose(t *testing.T) {
+	fmt.Println("Running Test: TestDatastoreAfterClose")
+
+	// Requests still draining get errors rather than panics
+	db := NewMongoDatastore()
+	db.Close()
+	if _, err := db.StoreContact(Contact{Email: "a@example.com"}); err != ErrDatastoreClosed {
+		t.Errorf("StoreContact after Close returned %v", err)
+	}
+	if _, err := db.RetrieveAPIKey(bson.NewObjectId().Hex()); err != ErrDatastoreClosed {
+		t.Errorf("RetrieveAPIKey after Close returned %v", err)
+	}
+	if _, err := db.IsSuppressed("a@example.com"); err != ErrDatastoreClosed {
+		t.Errorf("IsSuppressed after Close returned %v", err)
+	}
+	if users := db.RetrieveUsers(); len(users) != 0 {
+		t.Errorf("RetrieveUsers after Close returned %v", users)
+	}
+
+	fmt.Println("Test Complete.")
+}
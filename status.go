@@ -0,0 +1,252 @@
+// Mail Server health history reported by /status
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Guards Servers, which the pinger updates while requests read it
+var serversLock sync.RWMutex
+
+// Consecutive failed pings or sends that open a Mail Server's circuit
+const circuitFailureThreshold = 3
+
+// Send outcomes kept for the recent success rate
+const sendHistorySize = 100
+
+// Circuit states, open after repeated failures and half-open once a
+// success follows until the next one closes it
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+type pingResult struct {
+	at      time.Time
+	up      bool
+	latency time.Duration
+}
+
+// Recent pings and sends for one Mail Server. Pings are kept in a ring
+// buffer sized to cover a day at the configured PingPeriod
+type providerMonitor struct {
+	lock                sync.Mutex
+	pings               []pingResult
+	nextPing            int
+	sends               []bool
+	nextSend            int
+	consecutiveFailures int
+	lastError           string
+	lastErrorAt         time.Time
+	circuit             string
+}
+
+var monitorsLock sync.Mutex
+var providerMonitors = make(map[string]*providerMonitor)
+
+// Copy of the Mail Server statuses, safe to range over
+func serverStatuses() map[MailSender]bool {
+	serversLock.RLock()
+	servers := Servers
+	serversLock.RUnlock()
+	return serverStatusesOf(servers)
+}
+
+func serverStatusesOf(servers map[MailSender]bool) map[MailSender]bool {
+	serversLock.RLock()
+	defer serversLock.RUnlock()
+	result := make(map[MailSender]bool, len(servers))
+	for server, status := range servers {
+		result[server] = status
+	}
+	return result
+}
+
+func setServerStatus(servers map[MailSender]bool, server MailSender, status bool) {
+	serversLock.Lock()
+	servers[server] = status
+	serversLock.Unlock()
+}
+
+func pingHistorySize() int {
+	period := currentConfig().PingPeriod
+	if period <= 0 {
+		period = 60
+	}
+	size := int((24 * time.Hour) / (time.Duration(period) * time.Second))
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+func monitorFor(name string) *providerMonitor {
+	monitorsLock.Lock()
+	defer monitorsLock.Unlock()
+	monitor, ok := providerMonitors[name]
+	if !ok {
+		monitor = &providerMonitor{pings: make([]pingResult, 0, pingHistorySize()), circuit: CircuitClosed}
+		providerMonitors[name] = monitor
+	}
+	return monitor
+}
+
+// Resize every Mail Server's ping history for the current PingPeriod,
+// keeping the most recent pings that still fit
+func resizePingHistories() {
+	size := pingHistorySize()
+	monitorsLock.Lock()
+	defer monitorsLock.Unlock()
+	for _, monitor := range providerMonitors {
+		monitor.resizePings(size)
+	}
+}
+
+func (m *providerMonitor) resizePings(size int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Oldest first, the ring starts at nextPing once full
+	ordered := append(append([]pingResult{}, m.pings[m.nextPing:]...), m.pings[:m.nextPing]...)
+	if len(ordered) > size {
+		ordered = ordered[len(ordered)-size:]
+	}
+	m.pings = append(make([]pingResult, 0, size), ordered...)
+	m.nextPing = len(m.pings) % size
+}
+
+func recordPing(name string, up bool, latency time.Duration) {
+	monitor := monitorFor(name)
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+
+	result := pingResult{at: time.Now(), up: up, latency: latency}
+	if len(monitor.pings) < cap(monitor.pings) {
+		monitor.pings = append(monitor.pings, result)
+	} else {
+		monitor.pings[monitor.nextPing] = result
+	}
+	monitor.nextPing = (monitor.nextPing + 1) % cap(monitor.pings)
+	if up {
+		monitor.succeeded()
+	} else {
+		monitor.failed("ping failed")
+	}
+}
+
+func recordSendResult(name string, status int) {
+	monitor := monitorFor(name)
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+
+	ok := status >= 200 && status <= 299
+	if len(monitor.sends) < sendHistorySize {
+		monitor.sends = append(monitor.sends, ok)
+	} else {
+		monitor.sends[monitor.nextSend] = ok
+	}
+	monitor.nextSend = (monitor.nextSend + 1) % sendHistorySize
+	if ok {
+		monitor.succeeded()
+	} else {
+		monitor.failed("send returned " + strconv.Itoa(status))
+	}
+}
+
+func (m *providerMonitor) succeeded() {
+	m.consecutiveFailures = 0
+	switch m.circuit {
+	case CircuitOpen:
+		m.circuit = CircuitHalfOpen
+	case CircuitHalfOpen:
+		m.circuit = CircuitClosed
+	}
+}
+
+func (m *providerMonitor) failed(reason string) {
+	m.consecutiveFailures++
+	m.lastError = reason
+	m.lastErrorAt = time.Now()
+	if m.circuit == CircuitHalfOpen || m.consecutiveFailures >= circuitFailureThreshold {
+		m.circuit = CircuitOpen
+	}
+}
+
+// Share of pings within the window that found the server up, nil
+// without any
+func (m *providerMonitor) uptime(window time.Duration) *float64 {
+	since := time.Now().Add(-window)
+	total, up := 0, 0
+	for _, ping := range m.pings {
+		if ping.at.After(since) {
+			total++
+			if ping.up {
+				up++
+			}
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	ratio := float64(up) / float64(total)
+	return &ratio
+}
+
+// Fill in the ping, send and circuit history for a Mail Server
+func (m *providerMonitor) report(status *Status) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.pings) > 0 {
+		last := m.pings[(m.nextPing+len(m.pings)-1)%len(m.pings)]
+		status.LastPing = &last.at
+		status.LastPingLatencyMs = float64(last.latency) / float64(time.Millisecond)
+	}
+	if len(m.lastError) > 0 {
+		status.LastError = m.lastError
+		status.LastErrorAt = &m.lastErrorAt
+	}
+	status.ConsecutiveFailures = m.consecutiveFailures
+	status.Circuit = m.circuit
+	if len(m.sends) > 0 {
+		succeeded := 0
+		for _, ok := range m.sends {
+			if ok {
+				succeeded++
+			}
+		}
+		rate := float64(succeeded) / float64(len(m.sends))
+		status.RecentSends = len(m.sends)
+		status.SendSuccessRate = &rate
+	}
+	status.UptimeHour = m.uptime(time.Hour)
+	status.UptimeDay = m.uptime(24 * time.Hour)
+}
+
+// Current status and history of a Mail Server
+func providerStatus(name string, up bool) Status {
+	status := Status{Up: up, Circuit: CircuitClosed, Mode: providerOverride(name).Mode, InFlight: sendsInFlight(name)}
+	used, limited := providerUsage(name)
+	status.RateLimited = limited
+	for _, conf := range currentConfig().MailServers {
+		if conf.Name == name && conf.Limits.Daily > 0 {
+			remaining := conf.Limits.Daily - used
+			if remaining < 0 {
+				remaining = 0
+			}
+			status.DailyLimit = conf.Limits.Daily
+			status.DailyRemaining = &remaining
+		}
+	}
+	monitorsLock.Lock()
+	monitor, ok := providerMonitors[name]
+	monitorsLock.Unlock()
+	if ok {
+		monitor.report(&status)
+	}
+	return status
+}
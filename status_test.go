@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestProviderMonitor(t *testing.T) {
+	fmt.Println("Running Test: TestProviderMonitor")
+
+	// Setup
+	config = Config{PingPeriod: 3600}
+	monitor := monitorFor("TestProviderMonitor")
+
+	for i := 0; i < 30; i++ {
+		recordPing("TestProviderMonitor", i%2 == 0, time.Millisecond)
+	}
+	if len(monitor.pings) != 24 {
+		t.Errorf("Ping history holds %d results should be 24.", len(monitor.pings))
+	}
+	status := providerStatus("TestProviderMonitor", true)
+	if status.UptimeDay == nil || *status.UptimeDay != 0.5 || status.LastPing == nil || status.LastPingLatencyMs != 1 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	// Failures open the circuit, successes close it again
+	recordSendResult("TestProviderMonitor", 500)
+	recordSendResult("TestProviderMonitor", 500)
+	recordSendResult("TestProviderMonitor", 500)
+	status = providerStatus("TestProviderMonitor", true)
+	if status.Circuit != CircuitOpen || status.ConsecutiveFailures != 4 || status.LastError != "send returned 500" {
+		t.Errorf("Unexpected status after failures %+v", status)
+	}
+	recordSendResult("TestProviderMonitor", 200)
+	if providerStatus("TestProviderMonitor", true).Circuit != CircuitHalfOpen {
+		t.Errorf("Circuit should be half-open after a success")
+	}
+	recordSendResult("TestProviderMonitor", 200)
+	status = providerStatus("TestProviderMonitor", true)
+	if status.Circuit != CircuitClosed || status.RecentSends != 5 || *status.SendSuccessRate != 0.4 {
+		t.Errorf("Unexpected status after recovery %+v", status)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestPingHistoryResize(t *testing.T) {
+	fmt.Println("Running Test: TestPingHistoryResize")
+
+	// Setup
+	config = Config{PingPeriod: 3600}
+	monitor := monitorFor("TestPingHistoryResize")
+	for i := 0; i < 30; i++ {
+		recordPing("TestPingHistoryResize", true, time.Duration(i)*time.Millisecond)
+	}
+
+	// A longer period keeps the newest pings that cover a day
+	applyConfig(currentConfig(), Config{PingPeriod: 7200})
+	if len(monitor.pings) != 12 || cap(monitor.pings) != 12 || providerStatus("TestPingHistoryResize", true).LastPingLatencyMs != 29 {
+		t.Errorf("Ping history after resize holds %d of %d", len(monitor.pings), cap(monitor.pings))
+	}
+
+	// A shorter one makes room for more
+	applyConfig(currentConfig(), Config{PingPeriod: 1800})
+	recordPing("TestPingHistoryResize", true, 30*time.Millisecond)
+	if len(monitor.pings) != 13 || cap(monitor.pings) != 48 || providerStatus("TestPingHistoryResize", true).LastPingLatencyMs != 30 {
+		t.Errorf("Ping history after growing holds %d of %d", len(monitor.pings), cap(monitor.pings))
+	}
+	if monitor.pings[0].latency != 18*time.Millisecond {
+		t.Errorf("Oldest kept ping has latency %v should be 18ms", monitor.pings[0].latency)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestStatusHandler(t *testing.T) {
+	fmt.Println("Running Test: TestStatusHandler")
+
+	// Setup
+	datastore = NewMockDatastore()
+	config = Config{EmailThrottle: 5, PingPeriod: 60}
+	Servers = map[MailSender]bool{&MockServer{}: false}
+	initProviderLimits()
+	checkServers()
+	handler := buildTestHandler()
+	key := buildTestKey(ScopeSend)
+
+	res := doAuthRequest(handler, "GET", "/status", "", key)
+	var result map[string]Status
+	err := json.Unmarshal(res.Body.Bytes(), &result)
+	if err != nil {
+		t.Fatalf("Invalid /status body %s", res.Body.String())
+	}
+	status, ok := result["MockServer"]
+	if !ok || !status.Up || status.LastPing == nil || status.UptimeHour == nil || status.Circuit != CircuitClosed {
+		t.Errorf("Unexpected /status body %s", res.Body.String())
+	}
+
+	fmt.Println("Test Complete.")
+}
@@ -0,0 +1,107 @@
+// Suppression list checks and signed unsubscribe links
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var unsubscribeKey []byte
+
+// Load the key used to sign unsubscribe links. Without a configured
+// secret a random key is used, so links stop working after a restart
+func initUnsubscribeKey(secret string) {
+	if len(secret) > 0 {
+		unsubscribeKey = []byte(secret)
+		return
+	}
+	if len(currentConfig().BaseUrl) > 0 {
+		Log.Warn("No unsubscribeSecret configured. Unsubscribe links will not survive a restart.")
+	}
+	unsubscribeKey = make([]byte, 32)
+	_, err := rand.Read(unsubscribeKey)
+	check(err)
+}
+
+// Normalize and validate a Suppression before storing it
+func normalizeSuppression(suppression *Suppression) error {
+	suppression.Email = strings.ToLower(strings.TrimSpace(suppression.Email))
+	if !contactEmailRegex.MatchString(suppression.Email) {
+		return ErrInvalidEmail
+	}
+	if len(suppression.Reason) == 0 {
+		suppression.Reason = "manual"
+	}
+	if suppression.Created.IsZero() {
+		suppression.Created = time.Now().UTC()
+	}
+	return nil
+}
+
+// Signature for an unsubscribe link for the given address
+func unsubscribeSignature(email string) string {
+	mac := hmac.New(sha256.New, unsubscribeKey)
+	mac.Write([]byte(strings.ToLower(email)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func validUnsubscribeSignature(email string, sig string) bool {
+	expected := unsubscribeSignature(email)
+	return hmac.Equal([]byte(expected), []byte(sig))
+}
+
+// Build the one-click unsubscribe URL for an address
+func unsubscribeUrl(email string) string {
+	values := url.Values{}
+	values.Set("email", email)
+	values.Set("sig", unsubscribeSignature(email))
+	return strings.TrimRight(currentConfig().BaseUrl, "/") + "/unsubscribe?" + values.Encode()
+}
+
+// Remove suppressed addresses from the message recipients
+func filterSuppressed(store Datastore, message Message) (Message, []string, error) {
+	allowed := []string{}
+	suppressed := []string{}
+	for _, to := range message.To {
+		found, err := store.IsSuppressed(strings.ToLower(strings.TrimSpace(to)))
+		if err != nil {
+			return message, nil, err
+		}
+		if found {
+			suppressed = append(suppressed, to)
+		} else {
+			allowed = append(allowed, to)
+		}
+	}
+	message.To = allowed
+	return message, suppressed, nil
+}
+
+// Split messages per recipient and add List-Unsubscribe headers when a
+// BaseUrl is configured to build links from
+func addUnsubscribeHeaders(messages []Message) []Message {
+	if len(currentConfig().BaseUrl) == 0 {
+		return messages
+	}
+	result := []Message{}
+	for _, message := range messages {
+		for _, to := range message.To {
+			personal := message
+			personal.To = []string{to}
+			personal.Headers = make(map[string]string)
+			for k, v := range message.Headers {
+				personal.Headers[k] = v
+			}
+			personal.Headers["List-Unsubscribe"] = "<" + unsubscribeUrl(to) + ">"
+			personal.Headers["List-Unsubscribe-Post"] = "List-Unsubscribe=One-Click"
+			result = append(result, personal)
+		}
+	}
+	return result
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSuppressedRecipients(t *testing.T) {
+	fmt.Println("Running Test: TestSuppressedRecipients")
+
+	// Setup
+	datastore = NewMockDatastore()
+	datastore.StoreSuppression(Suppression{Email: "Bounced@Example.com", Reason: "bounce"})
+
+	message, suppressed, err := filterSuppressed(datastore, Message{To: []string{"bounced@example.com", "ok@example.com"}})
+	if err != nil || len(message.To) != 1 || len(suppressed) != 1 {
+		t.Errorf("filterSuppressed returned %v and %v, %v.", message.To, suppressed, err)
+	}
+
+	res := doAuthRequest(messageHandler, "POST", "/messages/", `{"to":["bounced@example.com"],"from":"me@example.com","subject":"Hi","text":"Hi"}`, buildTestKey(ScopeSend))
+	if res.Code != 422 {
+		t.Errorf("Send to suppressed address returned %d should be 422.", res.Code)
+	}
+
+	// A suppression list that cannot be checked refuses the send as unavailable
+	key := buildTestKey(ScopeSend)
+	datastore.Close()
+	res = doAuthRequest(messageHandler, "POST", "/messages/", `{"to":["ok@example.com"],"from":"me@example.com","subject":"Hi","text":"Hi"}`, key)
+	if res.Code != 503 {
+		t.Errorf("Send with the datastore down returned %d should be 503.", res.Code)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestUnsubscribeLink(t *testing.T) {
+	fmt.Println("Running Test: TestUnsubscribeLink")
+
+	// Setup
+	datastore = NewMockDatastore()
+	config = Config{BaseUrl: "https://mail.example.com/"}
+	initUnsubscribeKey("testSecret")
+
+	messages := addUnsubscribeHeaders([]Message{{To: []string{"a@example.com", "b@example.com"}}})
+	if len(messages) != 2 || messages[0].Headers["List-Unsubscribe-Post"] != "List-Unsubscribe=One-Click" {
+		t.Fatalf("addUnsubscribeHeaders returned %+v", messages)
+	}
+
+	link := strings.Trim(messages[0].Headers["List-Unsubscribe"], "<>")
+	if !strings.HasPrefix(link, "https://mail.example.com/unsubscribe?") {
+		t.Errorf("Unexpected unsubscribe link %s", link)
+	}
+	path := strings.TrimPrefix(link, "https://mail.example.com")
+
+	res := doRequest(unsubscribeHandler, "POST", path+"x", "List-Unsubscribe=One-Click")
+	if res.Code != 403 {
+		t.Errorf("Tampered link returned %d should be 403.", res.Code)
+	}
+
+	req := httptest.NewRequest("POST", path, strings.NewReader("List-Unsubscribe=One-Click"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res = httptest.NewRecorder()
+	unsubscribeHandler(res, req)
+	if res.Code != 200 {
+		t.Errorf("One-click unsubscribe returned %d should be 200.", res.Code)
+	}
+	if found, _ := datastore.IsSuppressed("a@example.com"); !found {
+		t.Errorf("Address should be suppressed after unsubscribe.")
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestGetSuppression(t *testing.T) {
+	fmt.Println("Running Test: TestGetSuppression")
+
+	// Setup
+	datastore = NewMockDatastore()
+	config = Config{EmailThrottle: 5}
+	handler, key := buildTestHandler(), buildTestKey(ScopeAdmin)
+	datastore.StoreSuppression(Suppression{Email: "bounced@example.com", Reason: "bounce"})
+
+	res := doAuthRequest(handler, "GET", "/suppressions/Bounced@Example.com", "", key)
+	if res.Code != 200 || !strings.Contains(res.Body.String(), `"bounce"`) {
+		t.Errorf("GET of suppressed address returned %d: %s", res.Code, res.Body.String())
+	}
+	res = doAuthRequest(handler, "GET", "/suppressions/ok@example.com", "", key)
+	if res.Code != 404 {
+		t.Errorf("GET of unsuppressed address returned %d should be 404.", res.Code)
+	}
+
+	fmt.Println("Test Complete.")
+}
@@ -0,0 +1,218 @@
+// HTTPS serving with certificate files or ACME, client certificates,
+// HTTP redirects and HSTS
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+type TLSConfig struct {
+	CertFile              string              // PEM certificate chain, with KeyFile
+	KeyFile               string              // PEM private key
+	MinVersion            string              // 1.2 (default) or 1.3
+	ClientCAFile          string              // PEM CAs client certificates are verified against
+	RequireClientCert     bool                // Refuse connections without a verified client certificate
+	ClientCerts           map[string][]string // Roles granted to client certificates by subject common name
+	RedirectPort          string              // Plain HTTP port redirecting to HTTPS, also answers ACME challenges
+	HSTSMaxAge            int                 // Strict-Transport-Security max-age in seconds, zero sends none
+	HSTSIncludeSubdomains bool
+	ACME                  ACMEConfig
+}
+
+// Certificates issued and renewed automatically by an ACME CA
+type ACMEConfig struct {
+	Domains      []string // Names to request certificates for, enables ACME
+	Email        string   // Contact address for the CA account
+	DirectoryUrl string   // Defaults to Let's Encrypt, e.g. https://localhost:14000/dir for Pebble
+	CAFile       string   // Extra PEM CAs trusted for the directory, e.g. Pebble's test CA
+	CacheDir     string   // Where certificates and the account key are kept, default certs
+}
+
+var tlsVersions = map[string]uint16{"": tls.VersionTLS12, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+func tlsEnabled(conf TLSConfig) bool {
+	return len(conf.CertFile) > 0 || len(conf.ACME.Domains) > 0
+}
+
+// Check the TLS settings, files are only read when serving starts
+func validateTLS(conf TLSConfig, roles map[string]RolePolicy) []string {
+	errs := []string{}
+	if (len(conf.CertFile) > 0) != (len(conf.KeyFile) > 0) {
+		errs = append(errs, "TLS.CertFile and TLS.KeyFile must be set together")
+	}
+	if len(conf.CertFile) > 0 && len(conf.ACME.Domains) > 0 {
+		errs = append(errs, "TLS.CertFile and TLS.ACME.Domains can't both be set")
+	}
+	if _, ok := tlsVersions[conf.MinVersion]; !ok {
+		errs = append(errs, fmt.Sprintf("TLS.MinVersion must be 1.2 or 1.3, got %q", conf.MinVersion))
+	}
+	if (conf.RequireClientCert || len(conf.ClientCerts) > 0) && len(conf.ClientCAFile) == 0 {
+		errs = append(errs, "TLS.ClientCAFile is needed to verify client certificates")
+	}
+	for name, certRoles := range conf.ClientCerts {
+		for _, role := range certRoles {
+			if _, ok := roles[role]; !ok {
+				errs = append(errs, fmt.Sprintf("TLS.ClientCerts.%s: unknown role %s", name, role))
+			}
+		}
+	}
+	if len(conf.RedirectPort) > 0 {
+		if port, err := strconv.Atoi(conf.RedirectPort); err != nil || port < 1 || port > 65535 {
+			errs = append(errs, fmt.Sprintf("TLS.RedirectPort %q is not a valid port", conf.RedirectPort))
+		}
+	}
+	if conf.HSTSMaxAge < 0 {
+		errs = append(errs, "TLS.HSTSMaxAge must not be negative")
+	}
+	return errs
+}
+
+// The config to serve HTTPS with and, for ACME, the certificate manager
+func buildTLSConfig(conf TLSConfig) (*tls.Config, *autocert.Manager, error) {
+	tlsConf := &tls.Config{MinVersion: tlsVersions[conf.MinVersion]}
+	var manager *autocert.Manager
+
+	if len(conf.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	} else if len(conf.ACME.Domains) > 0 {
+		cacheDir := conf.ACME.CacheDir
+		if len(cacheDir) == 0 {
+			cacheDir = "certs"
+		}
+		manager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(conf.ACME.Domains...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      conf.ACME.Email,
+		}
+		if len(conf.ACME.DirectoryUrl) > 0 || len(conf.ACME.CAFile) > 0 {
+			client := &acme.Client{DirectoryURL: conf.ACME.DirectoryUrl}
+			if len(conf.ACME.CAFile) > 0 {
+				pool, err := loadCertPool(conf.ACME.CAFile, true)
+				if err != nil {
+					return nil, nil, err
+				}
+				client.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+			}
+			manager.Client = client
+		}
+		tlsConf.GetCertificate = manager.GetCertificate
+		tlsConf.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	} else {
+		return nil, nil, errors.New("no certificate configured")
+	}
+
+	if len(conf.ClientCAFile) > 0 {
+		pool, err := loadCertPool(conf.ClientCAFile, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConf.ClientCAs = pool
+		tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+		if conf.RequireClientCert {
+			tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsConf, manager, nil
+}
+
+// CAs from a PEM file, added to the system ones if withSystem
+func loadCertPool(name string, withSystem bool) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if withSystem {
+		if system, err := x509.SystemCertPool(); err == nil {
+			pool = system
+		}
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", name)
+	}
+	return pool, nil
+}
+
+// Add Strict-Transport-Security to responses sent over TLS
+func hstsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conf := currentConfig().TLS
+		if req.TLS != nil && conf.HSTSMaxAge > 0 {
+			value := "max-age=" + strconv.Itoa(conf.HSTSMaxAge)
+			if conf.HSTSIncludeSubdomains {
+				value += "; includeSubDomains"
+			}
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Redirect plain HTTP requests to the same URL on the HTTPS port
+func redirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		status := http.StatusPermanentRedirect
+		if req.Method == "GET" || req.Method == "HEAD" {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), status)
+	})
+}
+
+// Serve the redirect, and ACME HTTP challenges, on port until server
+// shuts down
+func startRedirectServer(server *http.Server, port string, httpsPort string, manager *autocert.Manager) {
+	handler := redirectHandler(httpsPort)
+	if manager != nil {
+		handler = manager.HTTPHandler(handler)
+	}
+	redirect := &http.Server{Addr: ":" + port, Handler: handler}
+	server.RegisterOnShutdown(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+		defer cancel()
+		redirect.Shutdown(ctx)
+	})
+	go func() {
+		err := redirect.ListenAndServe()
+		if err != http.ErrServerClosed {
+			Log.Error("HTTP redirect server stopped", "port", port, "error", err)
+		}
+	}()
+}
+
+// Identity of a caller presenting a verified client certificate whose
+// common name is granted roles under TLS.ClientCerts
+func authenticateClientCert(req *http.Request) (Identity, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return Identity{}, false
+	}
+	name := req.TLS.VerifiedChains[0][0].Subject.CommonName
+	roles, ok := currentConfig().TLS.ClientCerts[name]
+	if !ok || len(name) == 0 {
+		return Identity{}, false
+	}
+	return rolesIdentity(Identity{Name: name, ClientId: "cert:" + name}, roles), true
+}
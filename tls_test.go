@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create a certificate for name signed by parent, or self signed. PEM
+// files are written to dir as name.crt and name.key
+func writeTestCert(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	fmt.Println("Running Test: TestBuildTLSConfig")
+
+	// Setup
+	dir, _ := ioutil.TempDir("", "maelstrom")
+	defer os.RemoveAll(dir)
+	writeTestCert(t, dir, "localhost", nil, nil)
+
+	conf, manager, err := buildTLSConfig(TLSConfig{CertFile: filepath.Join(dir, "localhost.crt"), KeyFile: filepath.Join(dir, "localhost.key"), MinVersion: "1.3"})
+	if err != nil || len(conf.Certificates) != 1 || conf.MinVersion != tls.VersionTLS13 || manager != nil {
+		t.Errorf("Certificate files not loaded: %v", err)
+	}
+
+	// ACME against a test CA such as Pebble
+	acme := ACMEConfig{Domains: []string{"mail.example.com"}, DirectoryUrl: "https://localhost:14000/dir", CAFile: filepath.Join(dir, "localhost.crt"), CacheDir: dir}
+	conf, manager, err = buildTLSConfig(TLSConfig{ACME: acme})
+	if err != nil || manager == nil || manager.Client.DirectoryURL != acme.DirectoryUrl || conf.GetCertificate == nil || conf.MinVersion != tls.VersionTLS12 {
+		t.Errorf("ACME not configured: %v", err)
+	}
+	if err := manager.HostPolicy(nil, "other.example.com"); err == nil {
+		t.Errorf("Certificate allowed for an unconfigured domain")
+	}
+
+	for name, invalid := range map[string]TLSConfig{
+		"KeyFile":      {CertFile: "server.crt"},
+		"both be set":  {CertFile: "server.crt", KeyFile: "server.key", ACME: ACMEConfig{Domains: []string{"mail.example.com"}}},
+		"MinVersion":   {MinVersion: "1.0"},
+		"ClientCAFile": {RequireClientCert: true},
+		"unknown role": {ClientCAFile: "ca.crt", ClientCerts: map[string][]string{"billing": {"owner"}}},
+		"RedirectPort": {RedirectPort: "http"},
+		"HSTSMaxAge":   {HSTSMaxAge: -1},
+	} {
+		errs := validateTLS(invalid, map[string]RolePolicy{"sender": {Scopes: []string{ScopeSend}}})
+		if !strings.Contains(strings.Join(errs, "\n"), name) {
+			t.Errorf("TLS config with bad %s gave %v", name, errs)
+		}
+	}
+
+	// Client certificates may use the default roles when none are configured
+	defaults := defaultConfig()
+	defaults.TLS = TLSConfig{ClientCAFile: "ca.crt", ClientCerts: map[string][]string{"billing": {RoleSender}}}
+	if err := validateConfig(defaults); err != nil {
+		t.Errorf("Client certificate with a default role gave %v", err)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestClientCertAuth(t *testing.T) {
+	fmt.Println("Running Test: TestClientCertAuth")
+
+	// Setup
+	dir, _ := ioutil.TempDir("", "maelstrom")
+	defer os.RemoveAll(dir)
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "billing", ca, caKey)
+	writeTestCert(t, dir, "unknown", ca, caKey)
+	datastore = NewMockDatastore()
+	config = Config{EmailThrottle: 5, PingPeriod: 60, Roles: map[string]RolePolicy{"reader": {Scopes: []string{ScopeContactsRead}}}}
+	config.TLS = TLSConfig{ClientCAFile: filepath.Join(dir, "ca.crt"), ClientCerts: map[string][]string{"billing": {"reader"}}}
+	tlsConf, _, err := buildTLSConfig(TLSConfig{CertFile: filepath.Join(dir, "ca.crt"), KeyFile: filepath.Join(dir, "ca.key"), ClientCAFile: config.TLS.ClientCAFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(buildTestHandler())
+	server.TLS = tlsConf
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(certName string) int {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		if len(certName) > 0 {
+			cert, err := tls.LoadX509KeyPair(filepath.Join(dir, certName+".crt"), filepath.Join(dir, certName+".key"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{cert}
+		}
+		res, err := client.Get(server.URL + "/history")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if code := get("billing"); code != 200 {
+		t.Errorf("GET /history with a known client certificate returned %d", code)
+	}
+	if code := get("unknown"); code != 401 {
+		t.Errorf("GET /history with an unmapped client certificate returned %d should be 401", code)
+	}
+	if code := get(""); code != 401 {
+		t.Errorf("GET /history without credentials returned %d should be 401", code)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestRedirectAndHSTS(t *testing.T) {
+	fmt.Println("Running Test: TestRedirectAndHSTS")
+
+	req := httptest.NewRequest("GET", "http://mail.example.com:8080/status?verbose=1", nil)
+	res := httptest.NewRecorder()
+	redirectHandler("8443").ServeHTTP(res, req)
+	if res.Code != 301 || res.Header().Get("Location") != "https://mail.example.com:8443/status?verbose=1" {
+		t.Errorf("GET redirected with %d to %s", res.Code, res.Header().Get("Location"))
+	}
+	req = httptest.NewRequest("POST", "http://mail.example.com/messages/", nil)
+	res = httptest.NewRecorder()
+	redirectHandler("443").ServeHTTP(res, req)
+	if res.Code != 308 || res.Header().Get("Location") != "https://mail.example.com/messages/" {
+		t.Errorf("POST redirected with %d to %s", res.Code, res.Header().Get("Location"))
+	}
+
+	config = Config{TLS: TLSConfig{HSTSMaxAge: 31536000, HSTSIncludeSubdomains: true}}
+	handler := hstsHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	req = httptest.NewRequest("GET", "https://mail.example.com/", nil)
+	req.TLS = &tls.ConnectionState{}
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Header().Get("Strict-Transport-Security") != "max-age=31536000; includeSubDomains" {
+		t.Errorf("HSTS header %q over TLS", res.Header().Get("Strict-Transport-Security"))
+	}
+	req = httptest.NewRequest("GET", "http://mail.example.com/", nil)
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if len(res.Header().Get("Strict-Transport-Security")) > 0 {
+		t.Errorf("HSTS header sent over plain HTTP")
+	}
+
+	fmt.Println("Test Complete.")
+}
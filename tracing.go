@@ -0,0 +1,386 @@
+// OpenTelemetry tracing with W3C trace context propagation, exported
+// to an OTLP/HTTP collector
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing settings. Spans are only exported when an endpoint is set
+type TracingConfig struct {
+	Endpoint    string            // OTLP/HTTP traces endpoint, e.g. http://localhost:4318/v1/traces
+	ServiceName string            // Reported as service.name, defaults to maelstrom
+	SampleRatio float64           // Share of new traces recorded, zero records all
+	Headers     map[string]string // Extra headers sent with each export
+}
+
+const (
+	SpanKindInternal = trace.SpanKindInternal
+	SpanKindServer   = trace.SpanKindServer
+	SpanKindClient   = trace.SpanKindClient
+)
+
+const tracerName = "github.com/idcrosby/maelstrom"
+
+// A timed operation within a trace
+type Span struct {
+	span trace.Span
+	kind trace.SpanKind
+}
+
+var tracerProvider = sdktrace.NewTracerProvider()
+var traceExporting bool
+var tracePropagator = propagation.TraceContext{}
+
+// Set up exporting, tracing stays local when no endpoint is configured.
+// New traces are sampled by ID, traces continued from a caller follow
+// the caller's sampled flag
+func initTracing(conf TracingConfig) {
+	ratio := conf.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	service := conf.ServiceName
+	if len(service) == 0 {
+		service = "maelstrom"
+	}
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+	}
+	traceExporting = false
+	if len(conf.Endpoint) > 0 {
+		exporter, err := otlptracehttp.New(context.Background(),
+			otlptracehttp.WithEndpointURL(conf.Endpoint), otlptracehttp.WithHeaders(conf.Headers))
+		if err != nil {
+			Log.Error("Error setting up trace export", "endpoint", conf.Endpoint, "error", err)
+		} else {
+			options = append(options, sdktrace.WithBatcher(exporter))
+			traceExporting = true
+			Log.Info("Exporting traces", "endpoint", conf.Endpoint)
+		}
+	}
+	previous := tracerProvider
+	tracerProvider = sdktrace.NewTracerProvider(options...)
+	previous.Shutdown(context.Background())
+}
+
+// Export queued spans and stop exporting, waiting up to timeout
+func flushTracing(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		Log.Warn("Error exporting traces", "error", err)
+	}
+}
+
+// Start a span as a child of the span in ctx, or of the remote caller's
+// span, or as the root of a new trace. The span must be ended
+func startSpan(ctx context.Context, name string, kind trace.SpanKind, attributes ...interface{}) (context.Context, *Span) {
+	ctx, span := tracerProvider.Tracer(tracerName).Start(ctx, name,
+		trace.WithSpanKind(kind), trace.WithAttributes(spanAttributes(attributes)...))
+	return ctx, &Span{span, kind}
+}
+
+// The current span in ctx, nil if there is none
+func spanFrom(ctx context.Context) *Span {
+	span := trace.SpanFromContext(ctx)
+	if !span.SpanContext().IsValid() {
+		return nil
+	}
+	kind := SpanKindInternal
+	if recorded, ok := span.(sdktrace.ReadOnlySpan); ok {
+		kind = recorded.SpanKind()
+	}
+	return &Span{span, kind}
+}
+
+func (s *Span) Context() trace.SpanContext {
+	return s.span.SpanContext()
+}
+
+// Rename the span, e.g. once the route handling a request is known
+func (s *Span) SetName(name string) {
+	s.span.SetName(name)
+}
+
+// Add key/value attributes
+func (s *Span) SetAttributes(attributes ...interface{}) {
+	s.span.SetAttributes(spanAttributes(attributes)...)
+}
+
+func (s *Span) SetError(err error) {
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// Record the HTTP status, marking server errors, and for clients any
+// refused request, as failed
+func (s *Span) SetHTTPStatus(status int) {
+	s.SetAttributes("http.response.status_code", status)
+	if status >= 500 || (s.kind == SpanKindClient && status >= 400) {
+		s.SetError(fmt.Errorf("HTTP %d", status))
+	}
+}
+
+// End the span, queueing it for export if sampled
+func (s *Span) End() {
+	s.span.End()
+}
+
+// Context carrying the caller's span from the traceparent header
+func extractTraceContext(req *http.Request) context.Context {
+	return tracePropagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+}
+
+// Copy of an outgoing request bound to ctx and carrying its span
+func tracedRequest(ctx context.Context, req *http.Request) *http.Request {
+	req = req.WithContext(ctx)
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req
+}
+
+// Span name for an incoming request, the method and top level resource
+func requestSpanName(req *http.Request) string {
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		path = path[:i+1]
+	}
+	return req.Method + " /" + path
+}
+
+// Key/value pairs as span attributes, redacted like log fields
+func spanAttributes(attributes []interface{}) []attribute.KeyValue {
+	result := make([]attribute.KeyValue, 0, len(attributes)/2)
+	for i := 0; i+1 < len(attributes); i += 2 {
+		key := fmt.Sprint(attributes[i])
+		switch v := redactValue(key, attributes[i+1]).(type) {
+		case bool:
+			result = append(result, attribute.Bool(key, v))
+		case int:
+			result = append(result, attribute.Int(key, v))
+		case int64:
+			result = append(result, attribute.Int64(key, v))
+		case float64:
+			result = append(result, attribute.Float64(key, v))
+		default:
+			result = append(result, attribute.String(key, fmt.Sprint(v)))
+		}
+	}
+	return result
+}
+
+// Datastore recording a span for each call made while handling a request
+type tracedDatastore struct {
+	ctx   context.Context
+	store Datastore
+}
+
+// The datastore for a request, logging against it and traced when the
+// request is being recorded
+func requestStore(req *http.Request) Datastore {
+	store := datastore
+	if store != nil {
+		store = store.WithContext(req.Context())
+	}
+	if !traceExporting || !trace.SpanContextFromContext(req.Context()).IsSampled() {
+		return store
+	}
+	return tracedDatastore{req.Context(), store}
+}
+
+// Start a span for the operation, returning the func ending it
+func (d tracedDatastore) trace(operation string) func() {
+	_, span := startSpan(d.ctx, "datastore "+operation, SpanKindClient, "db.operation.name", operation)
+	return span.End
+}
+
+func (d tracedDatastore) WithContext(ctx context.Context) Datastore {
+	return tracedDatastore{ctx, d.store.WithContext(ctx)}
+}
+
+func (d tracedDatastore) Status() bool {
+	defer d.trace("Status")()
+	return d.store.Status()
+}
+
+func (d tracedDatastore) StoreContact(contact Contact) (Contact, error) {
+	defer d.trace("StoreContact")()
+	return d.store.StoreContact(contact)
+}
+
+func (d tracedDatastore) DeleteContact(id string) bool {
+	defer d.trace("DeleteContact")()
+	return d.store.DeleteContact(id)
+}
+
+func (d tracedDatastore) UpdateContact(contact Contact) (Contact, error) {
+	defer d.trace("UpdateContact")()
+	return d.store.UpdateContact(contact)
+}
+
+func (d tracedDatastore) MergeContacts(targetId string, sourceId string) (Contact, error) {
+	defer d.trace("MergeContacts")()
+	return d.store.MergeContacts(targetId, sourceId)
+}
+
+func (d tracedDatastore) AddContactTag(id string, tag string) (Contact, error) {
+	defer d.trace("AddContactTag")()
+	return d.store.AddContactTag(id, tag)
+}
+
+func (d tracedDatastore) RemoveContactTag(id string, tag string) (Contact, error) {
+	defer d.trace("RemoveContactTag")()
+	return d.store.RemoveContactTag(id, tag)
+}
+
+func (d tracedDatastore) RetrieveContactsBy(param string, value string) []Contact {
+	defer d.trace("RetrieveContactsBy")()
+	return d.store.RetrieveContactsBy(param, value)
+}
+
+func (d tracedDatastore) StoreSuppression(suppression Suppression) (Suppression, error) {
+	defer d.trace("StoreSuppression")()
+	return d.store.StoreSuppression(suppression)
+}
+
+func (d tracedDatastore) RetrieveSuppressions() []Suppression {
+	defer d.trace("RetrieveSuppressions")()
+	return d.store.RetrieveSuppressions()
+}
+
+func (d tracedDatastore) RetrieveSuppression(email string) (Suppression, error) {
+	defer d.trace("RetrieveSuppression")()
+	return d.store.RetrieveSuppression(email)
+}
+
+func (d tracedDatastore) IsSuppressed(email string) (bool, error) {
+	defer d.trace("IsSuppressed")()
+	return d.store.IsSuppressed(email)
+}
+
+func (d tracedDatastore) DeleteSuppression(email string) bool {
+	defer d.trace("DeleteSuppression")()
+	return d.store.DeleteSuppression(email)
+}
+
+func (d tracedDatastore) StoreAPIKey(key APIKey) (APIKey, error) {
+	defer d.trace("StoreAPIKey")()
+	return d.store.StoreAPIKey(key)
+}
+
+func (d tracedDatastore) RetrieveAPIKey(id string) (APIKey, error) {
+	defer d.trace("RetrieveAPIKey")()
+	return d.store.RetrieveAPIKey(id)
+}
+
+func (d tracedDatastore) RetrieveAPIKeys() []APIKey {
+	defer d.trace("RetrieveAPIKeys")()
+	return d.store.RetrieveAPIKeys()
+}
+
+func (d tracedDatastore) RevokeAPIKey(id string) bool {
+	defer d.trace("RevokeAPIKey")()
+	return d.store.RevokeAPIKey(id)
+}
+
+func (d tracedDatastore) StoreUser(user User) (User, error) {
+	defer d.trace("StoreUser")()
+	return d.store.StoreUser(user)
+}
+
+func (d tracedDatastore) RetrieveUser(username string) (User, error) {
+	defer d.trace("RetrieveUser")()
+	return d.store.RetrieveUser(username)
+}
+
+func (d tracedDatastore) RetrieveUserById(id string) (User, error) {
+	defer d.trace("RetrieveUserById")()
+	return d.store.RetrieveUserById(id)
+}
+
+func (d tracedDatastore) RetrieveUserBySubject(issuer string, subject string) (User, error) {
+	defer d.trace("RetrieveUserBySubject")()
+	return d.store.RetrieveUserBySubject(issuer, subject)
+}
+
+func (d tracedDatastore) UpdateUser(user User) error {
+	defer d.trace("UpdateUser")()
+	return d.store.UpdateUser(user)
+}
+
+func (d tracedDatastore) RetrieveUsers() []User {
+	defer d.trace("RetrieveUsers")()
+	return d.store.RetrieveUsers()
+}
+
+func (d tracedDatastore) DeleteUser(id string) bool {
+	defer d.trace("DeleteUser")()
+	return d.store.DeleteUser(id)
+}
+
+func (d tracedDatastore) StoreSession(session Session) error {
+	defer d.trace("StoreSession")()
+	return d.store.StoreSession(session)
+}
+
+func (d tracedDatastore) RetrieveSession(hash string) (Session, error) {
+	defer d.trace("RetrieveSession")()
+	return d.store.RetrieveSession(hash)
+}
+
+func (d tracedDatastore) DeleteSession(hash string) bool {
+	defer d.trace("DeleteSession")()
+	return d.store.DeleteSession(hash)
+}
+
+func (d tracedDatastore) StoreSendRecord(record SendRecord) error {
+	defer d.trace("StoreSendRecord")()
+	return d.store.StoreSendRecord(record)
+}
+
+func (d tracedDatastore) RetrieveSendRecords(userId string) []SendRecord {
+	defer d.trace("RetrieveSendRecords")()
+	return d.store.RetrieveSendRecords(userId)
+}
+
+func (d tracedDatastore) IncrementProviderUsage(name string, day string) error {
+	defer d.trace("IncrementProviderUsage")()
+	return d.store.IncrementProviderUsage(name, day)
+}
+
+func (d tracedDatastore) RetrieveProviderUsage(day string) map[string]int {
+	defer d.trace("RetrieveProviderUsage")()
+	return d.store.RetrieveProviderUsage(day)
+}
+
+func (d tracedDatastore) StoreProviderOverride(override ProviderOverride) error {
+	defer d.trace("StoreProviderOverride")()
+	return d.store.StoreProviderOverride(override)
+}
+
+func (d tracedDatastore) RetrieveProviderOverrides() []ProviderOverride {
+	defer d.trace("RetrieveProviderOverrides")()
+	return d.store.RetrieveProviderOverrides()
+}
+
+func (d tracedDatastore) Ping() bool {
+	defer d.trace("Ping")()
+	return d.store.Ping()
+}
+
+func (d tracedDatastore) Close() {
+	d.store.Close()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTraceparent(t *testing.T) {
+	fmt.Println("Running Test: TestTraceparent")
+
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("traceparent", header)
+	ctx := extractTraceContext(req)
+	parsed := trace.SpanContextFromContext(ctx)
+	if !parsed.IsValid() || !parsed.IsSampled() || parsed.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Could not parse traceparent %s: %v", header, parsed)
+	}
+	out := tracedRequest(ctx, httptest.NewRequest("POST", "/", nil))
+	if out.Header.Get("traceparent") != header {
+		t.Errorf("Formatted traceparent %s should be %s", out.Header.Get("traceparent"), header)
+	}
+	for _, invalid := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		req.Header.Set("traceparent", invalid)
+		if trace.SpanContextFromContext(extractTraceContext(req)).IsValid() {
+			t.Errorf("Invalid traceparent %s accepted", invalid)
+		}
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+// Collector decoding OTLP/HTTP protobuf exports, recording spans by name
+type fakeCollector struct {
+	*httptest.Server
+	lock     sync.Mutex
+	spans    map[string]*tracepb.Span
+	services map[string]bool
+	errors   []string
+}
+
+func newFakeCollector() *fakeCollector {
+	collector := &fakeCollector{spans: make(map[string]*tracepb.Span), services: make(map[string]bool)}
+	collector.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		collector.lock.Lock()
+		defer collector.lock.Unlock()
+		var export coltracepb.ExportTraceServiceRequest
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Method != "POST" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+			collector.errors = append(collector.errors, req.Method+" "+req.Header.Get("Content-Type"))
+		}
+		if err := proto.Unmarshal(body, &export); err != nil {
+			collector.errors = append(collector.errors, err.Error())
+			w.WriteHeader(400)
+			return
+		}
+		for _, resource := range export.ResourceSpans {
+			for _, attribute := range resource.Resource.Attributes {
+				if attribute.Key == "service.name" {
+					collector.services[attribute.Value.GetStringValue()] = true
+				}
+			}
+			for _, scope := range resource.ScopeSpans {
+				for _, span := range scope.Spans {
+					collector.spans[span.Name] = span
+				}
+			}
+		}
+		response, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(response)
+	}))
+	return collector
+}
+
+func TestTracePropagation(t *testing.T) {
+	fmt.Println("Running Test: TestTracePropagation")
+
+	// Setup
+	var providerTraceparent string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		providerTraceparent = req.Header.Get("traceparent")
+	}))
+	defer provider.Close()
+	collector := newFakeCollector()
+	defer collector.Close()
+	initTracing(TracingConfig{Endpoint: collector.URL + "/v1/traces"})
+	defer initTracing(TracingConfig{})
+
+	datastore = NewMockDatastore()
+	Servers = map[MailSender]bool{&MailGunServer{MailServer{Name: "MailGun", Url: provider.URL + "/"}}: true}
+	config = Config{EmailThrottle: 5}
+	initRateLimits()
+	initProviderLimits()
+	handler := buildTestHandler()
+	key := buildTestKey(ScopeSend)
+
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("POST", "/messages/", strings.NewReader(`{"to":["a@example.com"],"from":"me@example.com","subject":"Hi","text":"Hi"}`))
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set("traceparent", "00-"+traceId+"-00f067aa0ba902b7-01")
+	res := httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != 200 {
+		t.Fatalf("POST /messages/ returned %d", res.Code)
+	}
+	if !strings.HasPrefix(providerTraceparent, "00-"+traceId+"-") {
+		t.Errorf("Provider request traceparent %s not in trace %s", providerTraceparent, traceId)
+	}
+
+	tracerProvider.ForceFlush(context.Background())
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	if len(collector.errors) > 0 || !collector.services["maelstrom"] {
+		t.Errorf("Bad export %v for services %v", collector.errors, collector.services)
+	}
+	for _, name := range []string{"POST /messages/", "validate message", "filter suppressed", "personalize message", "rate limit", "select provider", "send message", "MailGun POST messages",
+		"datastore RetrieveAPIKey", "datastore IsSuppressed", "datastore IncrementProviderUsage"} {
+		span := collector.spans[name]
+		if span == nil || hex.EncodeToString(span.TraceId) != traceId {
+			t.Errorf("Span %s not exported in trace %s: %v", name, traceId, span)
+		}
+	}
+
+	// The request continues the caller's span and parents the pipeline
+	server, send := collector.spans["POST /messages/"], collector.spans["send message"]
+	if server != nil && (server.Kind != tracepb.Span_SPAN_KIND_SERVER || hex.EncodeToString(server.ParentSpanId) != "00f067aa0ba902b7") {
+		t.Errorf("Request span has kind %v and parent %x", server.Kind, server.ParentSpanId)
+	}
+	if client := collector.spans["MailGun POST messages"]; client != nil && send != nil &&
+		(client.Kind != tracepb.Span_SPAN_KIND_CLIENT || string(client.ParentSpanId) != string(send.SpanId)) {
+		t.Errorf("Provider span has kind %v and parent %x", client.Kind, client.ParentSpanId)
+	}
+
+	fmt.Println("Test Complete.")
+}
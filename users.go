@@ -0,0 +1,186 @@
+// User accounts, login sessions and CSRF protection for the web UI
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Roles which may be assigned to a User
+const (
+	RoleSender = "sender"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+// Default access policy, used when conf.json defines no roles
+var defaultRoles = map[string]RolePolicy{
+	RoleSender: {Scopes: []string{ScopeSend}},
+	RoleEditor: {Scopes: []string{ScopeContactsRead, ScopeContactsWrite}},
+	RoleAdmin:  {Scopes: []string{ScopeAdmin}},
+}
+
+const sessionCookie = "maelstrom_session"
+const csrfCookie = "maelstrom_csrf"
+const sessionLifetime = 24 * time.Hour
+
+// Hash compared against when a login names an unknown user, so response
+// times do not reveal which usernames exist
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("maelstrom"), bcrypt.DefaultCost)
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func checkPassword(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// Normalize and validate a User before storing it
+func normalizeUser(user *User) error {
+	user.Username = strings.ToLower(strings.TrimSpace(user.Username))
+	if len(user.Username) == 0 {
+		return ErrInvalidUser
+	}
+	for _, role := range user.Roles {
+		if _, ok := rolePolicies()[role]; !ok {
+			return ErrInvalidUser
+		}
+	}
+	return nil
+}
+
+// The configured roles, or the defaults
+func rolePolicies() map[string]RolePolicy {
+	return effectiveRoles(currentConfig().Roles)
+}
+
+// Roles in effect for the configured ones, the defaults if none are
+func effectiveRoles(roles map[string]RolePolicy) map[string]RolePolicy {
+	if len(roles) > 0 {
+		return roles
+	}
+	return defaultRoles
+}
+
+// Identity for a User with the scopes and From restrictions of its roles.
+// From is only restricted if every role granting send restricts it
+func userIdentity(user User) Identity {
+	return rolesIdentity(Identity{Name: user.Username, ClientId: "user:" + user.Id.Hex(), UserId: user.Id}, user.Roles)
+}
+
+// Grant identity the scopes and allowed From addresses of roles
+func rolesIdentity(identity Identity, roles []string) Identity {
+	identity.Scopes = []string{}
+	unrestricted := false
+	for _, role := range roles {
+		policy := rolePolicies()[role]
+		identity.Scopes = append(identity.Scopes, policy.Scopes...)
+		if !scopesGrant(policy.Scopes, ScopeSend) {
+			continue
+		}
+		if len(policy.AllowedFrom) == 0 {
+			unrestricted = true
+		}
+		identity.AllowedFrom = append(identity.AllowedFrom, policy.AllowedFrom...)
+	}
+	if unrestricted {
+		identity.AllowedFrom = nil
+	}
+	return identity
+}
+
+func randomToken() string {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	check(err)
+	return hex.EncodeToString(token)
+}
+
+// Start a session for the user. The returned token is sent as the cookie,
+// only its hash is stored
+func newSession(user User) (Session, string) {
+	token := randomToken()
+	session := Session{
+		Id:        hashAPIKey(token),
+		UserId:    user.Id,
+		CsrfToken: randomToken(),
+		Expires:   time.Now().UTC().Add(sessionLifetime),
+	}
+	return session, token
+}
+
+// Load the session referenced by the request cookie, if still valid
+func requestSession(req *http.Request) (Session, bool) {
+	cookie, err := req.Cookie(sessionCookie)
+	if err != nil || len(cookie.Value) == 0 {
+		return Session{}, false
+	}
+	session, err := requestStore(req).RetrieveSession(hashAPIKey(cookie.Value))
+	if err != nil || time.Now().After(session.Expires) {
+		return Session{}, false
+	}
+	return session, true
+}
+
+// Resolve the logged in user from the session cookie
+func authenticateSession(req *http.Request) (Identity, bool) {
+	session, ok := requestSession(req)
+	if !ok {
+		return Identity{}, false
+	}
+	user, err := requestStore(req).RetrieveUserById(session.UserId.Hex())
+	if err != nil {
+		return Identity{}, false
+	}
+	identity := userIdentity(user)
+	identity.csrfToken = session.CsrfToken
+	return identity, true
+}
+
+// Check the CSRF token sent as the X-CSRF-Token header or csrf_token form field
+func validCsrfToken(req *http.Request, expected string) bool {
+	token := req.Header.Get("X-CSRF-Token")
+	if len(token) == 0 {
+		token = req.FormValue("csrf_token")
+	}
+	return len(token) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+func setCookie(w http.ResponseWriter, req *http.Request, name string, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Add a sent message to the user's history
+func recordSend(ctx context.Context, store Datastore, identity Identity, message Message, sender MailSender, status int) {
+	record := SendRecord{
+		Id:       bson.NewObjectId(),
+		UserId:   identity.UserId,
+		To:       message.To,
+		From:     message.From,
+		Subject:  message.Subject,
+		Provider: sender.GetName(),
+		Status:   status,
+		Sent:     time.Now().UTC(),
+	}
+	if err := store.StoreSendRecord(record); err != nil {
+		logFrom(ctx).Error("Error storing send history", "error", err)
+	}
+}
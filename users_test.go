@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginSession(t *testing.T) {
+	fmt.Println("Running Test: TestLoginSession")
+
+	// Setup
+	datastore = NewMockDatastore()
+	handler := buildTestHandler()
+	buildTestUser("alice", "correct horse", RoleSender)
+
+	res := doRequest(handler, "GET", "/", "")
+	if res.Code != 302 {
+		t.Errorf("Root without session returned %d should be 302.", res.Code)
+	}
+
+	res = doLogin(handler, "alice", "wrong password")
+	if res.Code != 401 {
+		t.Errorf("Login with wrong password returned %d should be 401.", res.Code)
+	}
+
+	res = doLogin(handler, "Alice", "correct horse")
+	if res.Code != 303 {
+		t.Fatalf("Login returned %d should be 303.", res.Code)
+	}
+	session := findCookie(res, sessionCookie)
+	if session == nil || !session.HttpOnly {
+		t.Fatalf("Login should set an HttpOnly session cookie.")
+	}
+
+	req := httptest.NewRequest("GET", "/history", nil)
+	req.AddCookie(session)
+	res = httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != 200 {
+		t.Errorf("History with session returned %d should be 200.", res.Code)
+	}
+
+	// Session callers must send the CSRF token
+	req = httptest.NewRequest("POST", "/messages/", strings.NewReader("{}"))
+	req.AddCookie(session)
+	res = httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != 403 {
+		t.Errorf("Send without CSRF token returned %d should be 403.", res.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/logout", nil)
+	req.AddCookie(session)
+	res = httptest.NewRecorder()
+	handler(res, req)
+	if res.Code != 403 {
+		t.Errorf("Logout without CSRF token returned %d should be 403.", res.Code)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+func TestSendHistory(t *testing.T) {
+	fmt.Println("Running Test: TestSendHistory")
+
+	// Setup
+	datastore = NewMockDatastore()
+	user := buildTestUser("bob", "correct horse", RoleSender)
+	Servers = map[MailSender]bool{&MockServer{}: true}
+	config = Config{EmailThrottle: 5}
+	initRateLimits()
+	initProviderLimits()
+
+	identity := userIdentity(user)
+	req := httptest.NewRequest("POST", "/messages/", strings.NewReader(`{"to":["a@example.com"],"from":"bob@example.com","subject":"Hi","text":"Hi"}`))
+	req = withIdentity(req, identity)
+	res := httptest.NewRecorder()
+	messageHandler(res, req)
+	if res.Code != 200 {
+		t.Fatalf("Send returned %d should be 200.", res.Code)
+	}
+
+	records := datastore.RetrieveSendRecords(user.Id.Hex())
+	if len(records) != 1 || records[0].Provider != "MockServer" {
+		t.Errorf("Unexpected send history %+v", records)
+	}
+
+	fmt.Println("Test Complete.")
+}
+
+// Helper functions
+func buildTestUser(username string, password string, roles ...string) User {
+	hash, _ := hashPassword(password)
+	user, _ := datastore.StoreUser(User{Id: bson.NewObjectId(), Username: username, PasswordHash: hash, Roles: roles, Created: time.Now()})
+	return user
+}
+
+// Fetch the login form and post it with its CSRF token
+func doLogin(handler http.HandlerFunc, username string, password string) *httptest.ResponseRecorder {
+	res := doRequest(handler, "GET", "/login", "")
+	csrf := findCookie(res, csrfCookie)
+
+	form := url.Values{}
+	form.Set("username", username)
+	form.Set("password", password)
+	form.Set("csrf_token", csrf.Value)
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(csrf)
+	res = httptest.NewRecorder()
+	handler(res, req)
+	return res
+}
+
+func findCookie(res *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range res.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}